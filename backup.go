@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultBackupDir = "backups"
+
+// writeBackup saves the snapshot backup writes into a new file in dir and
+// returns its path. The file only appears once the whole snapshot is in it.
+func writeBackup(backup func(w io.Writer) error, dir string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("problem creating %s, %v", dir, err)
+	}
+
+	name := fmt.Sprintf("database-%s.json.gz", time.Now().UTC().Format("20060102T150405.000Z"))
+	path := filepath.Join(dir, name)
+
+	file, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("problem creating temp file in %s, %v", dir, err)
+	}
+	defer os.Remove(file.Name())
+
+	err = backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("problem writing %s, %v", path, err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return "", fmt.Errorf("problem renaming %s, %v", path, err)
+	}
+
+	return path, nil
+}
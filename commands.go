@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const (
+	defaultJSONDatabasePath   = "database.json"
+	defaultSQLiteDatabasePath = "database.db"
+)
+
+// runCommand runs the command name. Except for backup and reindex, which can
+// ask a running server, commands open the database themselves and so need
+// the server that has a JSON database open stopped first.
+func runCommand(name string, args []string, stdout io.Writer) error {
+	err := dispatchCommand(name, args, stdout)
+	if errors.Is(err, database.ErrDatabaseLocked) {
+		return fmt.Errorf("%w; stop the server before running %s", err, name)
+	}
+	return err
+}
+
+func dispatchCommand(name string, args []string, stdout io.Writer) error {
+	switch name {
+	case "migrate":
+		return runMigrate(args, stdout)
+	case "backup":
+		return runBackup(args, stdout)
+	case "restore":
+		return runRestore(args, stdout)
+	case "rekey":
+		return runRekey(args, stdout)
+	case "export":
+		return runExport(args, stdout)
+	case "import":
+		return runImport(args, stdout)
+	case "reindex":
+		return runReindex(args, stdout)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// databaseOptionsFromEnv reads the database settings shared by the server
+// and the commands from the environment.
+func databaseOptionsFromEnv() (database.Options, error) {
+	opts := database.Options{}
+
+	encoded := os.Getenv("DB_ENCRYPTION_KEY")
+	if encoded == "" {
+		return opts, nil
+	}
+
+	key, err := database.ParseEncryptionKey(encoded)
+	if err != nil {
+		return opts, fmt.Errorf("DB_ENCRYPTION_KEY: %v", err)
+	}
+
+	opts.EncryptionKey = key
+	return opts, nil
+}
+
+func runMigrate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dbPath := flags.String("db", defaultJSONDatabasePath, "Path to the JSON database.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	switch flags.Arg(0) {
+	case "status":
+		status, err := database.SchemaStatus(*dbPath, opts.EncryptionKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "schema version: %d (latest %d)\n", status.Version, status.Latest)
+		for _, pending := range status.Pending {
+			fmt.Fprintf(stdout, "pending: %s\n", pending)
+		}
+		return nil
+	case "up":
+		status, err := database.SchemaStatus(*dbPath, opts.EncryptionKey)
+		if err != nil {
+			return err
+		}
+
+		db, err := database.Open(*dbPath, opts)
+		if err != nil {
+			return err
+		}
+
+		err = db.Close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "migrated schema version %d to %d\n", status.Version, status.Latest)
+		return nil
+	default:
+		return fmt.Errorf("usage: migrate [-db path] status|up")
+	}
+}
+
+// runBackup writes a snapshot of the database into -dir. A running server
+// holds the JSON database's lock, so then the snapshot is downloaded from
+// the server's GET /admin/backup instead.
+func runBackup(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dbDriver := flags.String("db-driver", "json", "Database driver to use: json or sqlite.")
+	dbPath := flags.String("db", "", "Path to the database. Defaults to the driver's default path.")
+	dir := flags.String("dir", defaultBackupDir, "Directory to write the snapshot to.")
+	server := flags.String("server", "http://localhost:"+defaultPort, "URL of the server to ask for the snapshot when it has the database open.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	opts.ReadOnly = true
+
+	store, err := openStore(*dbDriver, *dbPath, opts)
+	if errors.Is(err, database.ErrDatabaseLocked) {
+		path, err := writeBackup(func(w io.Writer) error {
+			return getAdmin(*server, "/admin/backup", w)
+		}, *dir)
+		if err != nil {
+			return fmt.Errorf("database is locked and the server couldn't send a snapshot: %v", err)
+		}
+
+		fmt.Fprintln(stdout, path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	path, err := writeBackup(store.Backup, *dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, path)
+	return nil
+}
+
+func runRestore(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dbDriver := flags.String("db-driver", "json", "Database driver to use: json or sqlite.")
+	dbPath := flags.String("db", "", "Path to the database. Defaults to the driver's default path.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-db-driver json|sqlite] [-db path] snapshot.json.gz")
+	}
+
+	snapshot, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*dbDriver, *dbPath, opts)
+	if err != nil {
+		return err
+	}
+
+	err = store.Restore(snapshot)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	err = store.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "restored %s\n", flags.Arg(0))
+	return nil
+}
+
+func runRekey(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	dbPath := flags.String("db", defaultJSONDatabasePath, "Path to the JSON database.")
+	decrypt := flags.Bool("decrypt", false, "Store the database in plaintext instead of under a new key.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	var newKey []byte
+	if !*decrypt {
+		encoded := os.Getenv("DB_NEW_ENCRYPTION_KEY")
+		if encoded == "" {
+			return fmt.Errorf("usage: DB_NEW_ENCRYPTION_KEY=<key> rekey [-db path], or rekey -decrypt")
+		}
+
+		newKey, err = database.ParseEncryptionKey(encoded)
+		if err != nil {
+			return fmt.Errorf("DB_NEW_ENCRYPTION_KEY: %v", err)
+		}
+	}
+
+	// Rekeying is how an existing plaintext database gets encrypted, and how
+	// one left half encrypted by an older version is finished.
+	opts.AllowPlaintext = true
+	db, err := database.Open(*dbPath, opts)
+	if err != nil {
+		return err
+	}
+
+	err = db.Rekey(newKey)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, "rekeyed database; set DB_ENCRYPTION_KEY to the new key, existing backups keep their old key")
+	return nil
+}
+
+// runExport reads the database directly, so a JSON database in use by a
+// server can't be exported. Export a live database by restoring a backup
+// into another -db and exporting that.
+func runExport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbDriver := flags.String("db-driver", "json", "Database driver to use: json or sqlite.")
+	dbPath := flags.String("db", "", "Path to the database. Defaults to the driver's default path.")
+	format := flags.String("format", "jsonl", "Output format: jsonl or csv.")
+	entity := flags.String("entity", "all", "What to export: all, users or chirps.")
+	authorId := flags.Int("author", 0, "Only export this user and their chirps.")
+	sinceId := flags.Int("since-id", 0, "Only export chirps with at least this id.")
+	untilId := flags.Int("until-id", 0, "Only export chirps with at most this id.")
+	since := flags.String("since", "", "Only export records created at or after this RFC 3339 time, plus the authors of exported chirps.")
+	until := flags.String("until", "", "Only export records created before this RFC 3339 time, plus the authors of exported chirps.")
+	includeDeleted := flags.Bool("include-deleted", false, "Also export soft-deleted chirps, which import as deleted.")
+	output := flags.String("o", "", "File to write to. Defaults to stdout.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *entity != "all" && *entity != "users" && *entity != "chirps" {
+		return fmt.Errorf("unknown entity %q", *entity)
+	}
+
+	filter := exportFilter{
+		entity:         *entity,
+		authorId:       *authorId,
+		sinceId:        *sinceId,
+		untilId:        *untilId,
+		includeDeleted: *includeDeleted,
+	}
+	if *since != "" {
+		filter.since, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	if *until != "" {
+		filter.until, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+
+	w := stdout
+	var file *os.File
+	if *output != "" {
+		file, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	writer, err := newRecordWriter(*format, w)
+	if err != nil {
+		return err
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	opts.ReadOnly = true
+
+	store, err := openStore(*dbDriver, *dbPath, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	_, err = exportRecords(store, writer, filter)
+	if err != nil || file == nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func runImport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbDriver := flags.String("db-driver", "json", "Database driver to use: json or sqlite.")
+	dbPath := flags.String("db", "", "Path to the database. Defaults to the driver's default path.")
+	format := flags.String("format", "jsonl", "Input format: jsonl or csv.")
+	remapIds := flags.Bool("remap-ids", false, "Give imported records new ids instead of keeping theirs. Kept ids must be ones the database has never issued.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import [-db-driver json|sqlite] [-db path] [-format jsonl|csv] [-remap-ids] file|-")
+	}
+
+	r := io.Reader(os.Stdin)
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	reader, err := newRecordReader(*format, r)
+	if err != nil {
+		return err
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*dbDriver, *dbPath, opts)
+	if err != nil {
+		return err
+	}
+
+	result, err := importRecords(store, reader, *remapIds)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	err = store.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "imported %d users and %d chirps\n", result.Users, result.Chirps)
+	return nil
+}
+
+// runReindex asks a running server to rebuild its search index from its
+// store. The index lives in the server's memory, so there is nothing to
+// rebuild offline.
+func runReindex(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:"+defaultPort, "URL of the server whose index to rebuild.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Chirps int `json:"chirps"`
+	}{}
+	err = postAdmin(*server, "/admin/search/reindex", http.StatusOK, &result)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "reindexed %d chirps\n", result.Chirps)
+	return nil
+}
+
+// getAdmin copies the body of an admin endpoint on server to w.
+func getAdmin(server, path string, w io.Writer) error {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "ApiKey "+os.Getenv("ADMIN_API_KEY"))
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded %s", response.Status)
+	}
+
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// postAdmin calls an admin endpoint of a running server with ADMIN_API_KEY
+// and decodes its response into result.
+func postAdmin(server, path string, wantStatus int, result any) error {
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "ApiKey "+os.Getenv("ADMIN_API_KEY"))
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != wantStatus {
+		return fmt.Errorf("server responded %s", response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+func TestBackupAsksServerWhenLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	store, err := database.NewDB(path, false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer store.Close()
+	store.CreateUser("saved@example.com", "hash")
+
+	serverDir := t.TempDir()
+	server := httptest.NewServer(NewServer(apiConfig{DB: store, admin: store, adminApiKey: testAdminApiKey, backupDir: serverDir}, "").Handler)
+	defer server.Close()
+
+	t.Setenv("ADMIN_API_KEY", testAdminApiKey)
+	t.Setenv("DB_ENCRYPTION_KEY", "")
+
+	var stdout bytes.Buffer
+	dir := t.TempDir()
+	err = runBackup([]string{"-db", path, "-dir", dir, "-server", server.URL}, &stdout)
+	if err != nil {
+		t.Fatalf("error backing up a locked database: %v", err)
+	}
+
+	backupPath := strings.TrimSpace(stdout.String())
+	if filepath.Dir(backupPath) != dir {
+		t.Fatalf("backup path, got: %q, want a snapshot in %s", backupPath, dir)
+	}
+
+	entries, _ := os.ReadDir(serverDir)
+	if len(entries) != 0 {
+		t.Errorf("server backup directory, got: %d files, want it left empty", len(entries))
+	}
+
+	snapshot, err := os.Open(backupPath)
+	if err != nil {
+		t.Fatalf("error reading the server's snapshot: %v", err)
+	}
+	defer snapshot.Close()
+
+	restored := newTestStore(t)
+	err = restored.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("error restoring the server's snapshot: %v", err)
+	}
+
+	_, err = restored.GetUserByEmail("saved@example.com")
+	if err != nil {
+		t.Errorf("user in the server's snapshot, got: %v, want it restored", err)
+	}
+}
+
+func TestCommandsNeedServerStopped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	store, err := database.NewDB(path, false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer store.Close()
+
+	t.Setenv("DB_ENCRYPTION_KEY", "")
+
+	err = runCommand("export", []string{"-db", path}, &bytes.Buffer{})
+	if !errors.Is(err, database.ErrDatabaseLocked) || !strings.Contains(err.Error(), "stop the server") {
+		t.Errorf("export of a locked database, got: %v, want: %v telling to stop the server", err, database.ErrDatabaseLocked)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const (
+	userRecord  = "user"
+	chirpRecord = "chirp"
+)
+
+// exportRecord is one exported entity. Users are always written before
+// chirps so an import can resolve every AuthorId in a single pass.
+type exportRecord struct {
+	Type  string          `json:"type"`
+	User  *database.User  `json:"user,omitempty"`
+	Chirp *database.Chirp `json:"chirp,omitempty"`
+}
+
+type exportFilter struct {
+	entity   string
+	authorId int
+	sinceId  int
+	untilId  int
+	since    time.Time
+	until    time.Time
+	// includeDeleted exports soft-deleted chirps too, with their deleted_at.
+	includeDeleted bool
+}
+
+func (filter exportFilter) includesUser(user database.User) bool {
+	if filter.authorId != 0 && user.Id != filter.authorId {
+		return false
+	}
+	if !filter.since.IsZero() && user.CreatedAt.Before(filter.since) {
+		return false
+	}
+	if !filter.until.IsZero() && !user.CreatedAt.Before(filter.until) {
+		return false
+	}
+	return true
+}
+
+func (filter exportFilter) includesChirp(chirp database.Chirp) bool {
+	if filter.authorId != 0 && chirp.AuthorId != filter.authorId {
+		return false
+	}
+	if filter.sinceId != 0 && chirp.Id < filter.sinceId {
+		return false
+	}
+	if filter.untilId != 0 && chirp.Id > filter.untilId {
+		return false
+	}
+	if !filter.since.IsZero() && chirp.CreatedAt.Before(filter.since) {
+		return false
+	}
+	if !filter.until.IsZero() && !chirp.CreatedAt.Before(filter.until) {
+		return false
+	}
+	return true
+}
+
+// csvHeader names the CSV columns, which hold every field of a user or chirp
+// so a CSV export restores as fully as a JSON Lines one. deleted_at is only
+// set on chirps exported with -include-deleted. token_version and deleted_at
+// came last; files written before them read as version 0 and live.
+var csvHeader = []string{"type", "id", "email", "password_hash", "is_chirpy_red", "body", "author_id", "created_at", "updated_at", "token_version", "deleted_at"}
+
+const csvHeaderBeforeVersions = 9
+
+type recordWriter interface {
+	Write(record exportRecord) error
+	Flush() error
+}
+
+type recordReader interface {
+	// Read returns io.EOF once every record has been read.
+	Read() (exportRecord, error)
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case "jsonl":
+		return jsonlWriter{encoder: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvWriter{writer: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func newRecordReader(format string, r io.Reader) (recordReader, error) {
+	switch format {
+	case "jsonl":
+		return jsonlReader{decoder: json.NewDecoder(r)}, nil
+	case "csv":
+		return &csvReader{reader: csv.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (w jsonlWriter) Write(record exportRecord) error {
+	return w.encoder.Encode(record)
+}
+
+func (w jsonlWriter) Flush() error {
+	return nil
+}
+
+type jsonlReader struct {
+	decoder *json.Decoder
+}
+
+func (r jsonlReader) Read() (exportRecord, error) {
+	var record exportRecord
+	err := r.decoder.Decode(&record)
+	if err != nil {
+		return exportRecord{}, err
+	}
+
+	switch {
+	case record.Type == userRecord && record.User != nil:
+	case record.Type == chirpRecord && record.Chirp != nil:
+	default:
+		return exportRecord{}, fmt.Errorf("invalid %q record", record.Type)
+	}
+	return record, nil
+}
+
+type csvWriter struct {
+	writer      *csv.Writer
+	wroteHeader bool
+}
+
+func (w *csvWriter) Write(record exportRecord) error {
+	if !w.wroteHeader {
+		err := w.writer.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	if record.User != nil {
+		user := record.User
+		return w.writer.Write([]string{userRecord, strconv.Itoa(user.Id), user.Email, user.PasswordHash, strconv.FormatBool(user.IsChirpyRed), "", "", formatCSVTime(user.CreatedAt), formatCSVTime(user.UpdatedAt), strconv.Itoa(user.TokenVersion), ""})
+	}
+
+	chirp := record.Chirp
+	deletedAt := ""
+	if chirp.DeletedAt != nil {
+		deletedAt = formatCSVTime(*chirp.DeletedAt)
+	}
+	return w.writer.Write([]string{chirpRecord, strconv.Itoa(chirp.Id), "", "", "", chirp.Body, strconv.Itoa(chirp.AuthorId), formatCSVTime(chirp.CreatedAt), formatCSVTime(chirp.UpdatedAt), "", deletedAt})
+}
+
+func formatCSVTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (w *csvWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type csvReader struct {
+	reader     *csv.Reader
+	readHeader bool
+}
+
+func (r *csvReader) Read() (exportRecord, error) {
+	if !r.readHeader {
+		header, err := r.reader.Read()
+		if err != nil {
+			return exportRecord{}, err
+		}
+		if len(header) != len(csvHeader) && len(header) != csvHeaderBeforeVersions || header[0] != csvHeader[0] {
+			return exportRecord{}, errors.New("missing CSV header")
+		}
+		r.readHeader = true
+	}
+
+	row, err := r.reader.Read()
+	if err != nil {
+		return exportRecord{}, err
+	}
+	row = append(row, make([]string, len(csvHeader)-len(row))...)
+
+	id, err := strconv.Atoi(row[1])
+	if err != nil {
+		return exportRecord{}, fmt.Errorf("invalid id %q", row[1])
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, row[7])
+	if err != nil {
+		return exportRecord{}, fmt.Errorf("invalid created_at %q", row[7])
+	}
+
+	updatedAt, err := time.Parse(time.RFC3339Nano, row[8])
+	if err != nil {
+		return exportRecord{}, fmt.Errorf("invalid updated_at %q", row[8])
+	}
+
+	switch row[0] {
+	case userRecord:
+		isChirpyRed, err := strconv.ParseBool(row[4])
+		if err != nil {
+			return exportRecord{}, fmt.Errorf("invalid is_chirpy_red %q", row[4])
+		}
+		tokenVersion := 0
+		if row[9] != "" {
+			tokenVersion, err = strconv.Atoi(row[9])
+			if err != nil {
+				return exportRecord{}, fmt.Errorf("invalid token_version %q", row[9])
+			}
+		}
+		return exportRecord{Type: userRecord, User: &database.User{
+			Id:           id,
+			Email:        row[2],
+			PasswordHash: row[3],
+			IsChirpyRed:  isChirpyRed,
+			TokenVersion: tokenVersion,
+			CreatedAt:    createdAt,
+			UpdatedAt:    updatedAt,
+		}}, nil
+	case chirpRecord:
+		authorId, err := strconv.Atoi(row[6])
+		if err != nil {
+			return exportRecord{}, fmt.Errorf("invalid author_id %q", row[6])
+		}
+		var deletedAt *time.Time
+		if row[10] != "" {
+			t, err := time.Parse(time.RFC3339Nano, row[10])
+			if err != nil {
+				return exportRecord{}, fmt.Errorf("invalid deleted_at %q", row[10])
+			}
+			deletedAt = &t
+		}
+		return exportRecord{Type: chirpRecord, Chirp: &database.Chirp{
+			Id:        id,
+			Body:      row[5],
+			AuthorId:  authorId,
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+			DeletedAt: deletedAt,
+		}}, nil
+	default:
+		return exportRecord{}, fmt.Errorf("invalid %q record", row[0])
+	}
+}
+
+// exportPageSize is how many records exportRecords reads at a time.
+const exportPageSize = 500
+
+// exportRecords writes the users and live chirps in store that match filter,
+// each kind in id order, and reports how many records were written. The
+// authors of exported chirps are exported too, even if filter leaves them
+// out, so the export imports cleanly.
+//
+// Records are read a page at a time, so memory holds a page and the ids of
+// the chirps' authors rather than the whole store. Chirps are read twice:
+// once to find their authors, which are written first, then to write them.
+func exportRecords(store database.AdminStore, w recordWriter, filter exportFilter) (int, error) {
+	written := 0
+
+	authorIds := map[int]bool{}
+	if filter.entity != "users" {
+		err := eachExportedChirp(store, filter, func(chirp database.Chirp) error {
+			authorIds[chirp.AuthorId] = true
+			return nil
+		})
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if filter.entity != "chirps" {
+		for afterId := 0; ; {
+			users, err := store.ListUsers(afterId, exportPageSize)
+			if err != nil {
+				return written, err
+			}
+			if len(users) == 0 {
+				break
+			}
+			afterId = users[len(users)-1].Id
+
+			for _, user := range users {
+				if !filter.includesUser(user) && !authorIds[user.Id] {
+					continue
+				}
+				err = w.Write(exportRecord{Type: userRecord, User: &user})
+				if err != nil {
+					return written, err
+				}
+				written++
+			}
+		}
+	}
+
+	if filter.entity != "users" {
+		err := eachExportedChirp(store, filter, func(chirp database.Chirp) error {
+			err := w.Write(exportRecord{Type: chirpRecord, Chirp: &chirp})
+			if err == nil {
+				written++
+			}
+			return err
+		})
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, w.Flush()
+}
+
+// eachExportedChirp calls fn with each chirp that filter includes, in id
+// order, stopping at the first error. Soft-deleted chirps are skipped unless
+// the filter asks for them.
+func eachExportedChirp(store database.AdminStore, filter exportFilter, fn func(database.Chirp) error) error {
+	query := database.ChirpQuery{
+		AuthorId:       filter.authorId,
+		Since:          filter.since,
+		Until:          filter.until,
+		Limit:          exportPageSize,
+		IncludeDeleted: filter.includeDeleted,
+	}
+	if filter.sinceId > 1 {
+		query.AfterId = filter.sinceId - 1
+	}
+
+	for {
+		chirps, err := store.ListChirps(query)
+		if err != nil {
+			return err
+		}
+		if len(chirps) == 0 {
+			return nil
+		}
+		query.AfterId = chirps[len(chirps)-1].Id
+
+		for _, chirp := range chirps {
+			if filter.untilId != 0 && chirp.Id > filter.untilId {
+				return nil
+			}
+			if !filter.includesChirp(chirp) {
+				continue
+			}
+			err = fn(chirp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type importResult struct {
+	Users  int
+	Chirps int
+}
+
+// importRecords reads every record from r, checks the batch for duplicates
+// and orphans, and hands it to store.Import, which writes it in one
+// transaction so a rejected import changes nothing.
+//
+// Without remapIds records keep their ids and must not collide with existing
+// ones. With remapIds every record gets a fresh id from store, and chirps
+// follow their author to the author's new id.
+func importRecords(store database.AdminStore, r recordReader, remapIds bool) (importResult, error) {
+	var users []database.User
+	var chirps []database.Chirp
+	userIds := map[int]bool{}
+	emails := map[string]bool{}
+
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return importResult{}, fmt.Errorf("record %d: %v", line, err)
+		}
+
+		switch record.Type {
+		case userRecord:
+			user := *record.User
+			if userIds[user.Id] || emails[user.Email] {
+				return importResult{}, fmt.Errorf("record %d: user %d duplicates an earlier record", line, user.Id)
+			}
+			userIds[user.Id] = true
+			emails[user.Email] = true
+			users = append(users, user)
+		case chirpRecord:
+			chirp := *record.Chirp
+			// Without remapping, a chirp may also belong to a user that
+			// already exists in the target, which store.Import checks.
+			if remapIds && !userIds[chirp.AuthorId] {
+				return importResult{}, fmt.Errorf("record %d: chirp %d is orphaned, author %d is not in the import", line, chirp.Id, chirp.AuthorId)
+			}
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	err := store.Import(users, chirps, remapIds)
+	switch {
+	case errors.Is(err, database.ErrIdTaken):
+		return importResult{}, fmt.Errorf("%w, import with -remap-ids", err)
+	case errors.Is(err, database.ErrUserDoesNotExist):
+		return importResult{}, fmt.Errorf("chirp is orphaned: %w", err)
+	case err != nil:
+		return importResult{}, err
+	}
+
+	return importResult{Users: len(users), Chirps: len(chirps)}, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+func newExportSource(t *testing.T) *database.DB {
+	store := newTestStore(t)
+	first, _ := store.CreateUser("first@example.com", "hash-1")
+	second, _ := store.CreateUser("second@example.com", "hash-2")
+	store.UpgradeUserToRedByUserId(second.Id)
+	store.RevokeSessionsByUser(second.Id)
+	store.CreateChirp("hello, \"csv\"", first.Id)
+	store.CreateChirp("from second", second.Id)
+	store.CreateChirp("also first", first.Id)
+	deleted, _ := store.CreateChirp("deleted", second.Id)
+	store.DeleteChirpById(deleted.Id)
+	return store
+}
+
+const testExportDeletedChirpId = 4
+
+// storedUsers and storedChirps list a store's records in id order.
+func storedUsers(t *testing.T, store database.Store) []database.User {
+	t.Helper()
+
+	users, err := store.GetUsers()
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users
+}
+
+func storedChirps(t *testing.T, store database.Store) []database.Chirp {
+	t.Helper()
+
+	chirps, err := store.GetChirps()
+	if err != nil {
+		t.Fatalf("error listing chirps: %v", err)
+	}
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
+	return chirps
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			source := newExportSource(t)
+
+			var buf bytes.Buffer
+			writer, _ := newRecordWriter(format, &buf)
+			written, err := exportRecords(source, writer, exportFilter{entity: "all", includeDeleted: true})
+			if err != nil || written != 6 {
+				t.Fatalf("exportRecords, got: %d, %v, want: 6", written, err)
+			}
+
+			target := newTestStore(t)
+			reader, _ := newRecordReader(format, &buf)
+			result, err := importRecords(target, reader, false)
+			if err != nil {
+				t.Fatalf("error importing: %v", err)
+			}
+
+			AssertResponseBody(t, result, importResult{Users: 2, Chirps: 4})
+			AssertResponseBody(t, storedChirps(t, target), storedChirps(t, source))
+			AssertResponseBody(t, storedUsers(t, target), storedUsers(t, source))
+
+			deleted, err := target.GetDeletedChirpById(testExportDeletedChirpId)
+			want, _ := source.GetDeletedChirpById(testExportDeletedChirpId)
+			if err != nil || !deleted.DeletedAt.Equal(*want.DeletedAt) {
+				t.Errorf("deleted chirp after import, got: %+v, %v, want: %+v", deleted, err, want)
+			}
+		})
+	}
+}
+
+func TestCSVKeepsEveryField(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	deletedAt := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	records := []exportRecord{
+		{Type: userRecord, User: &database.User{Id: 1, Email: "user@example.com", PasswordHash: "hash", IsChirpyRed: true, TokenVersion: 3, CreatedAt: createdAt, UpdatedAt: createdAt}},
+		{Type: chirpRecord, Chirp: &database.Chirp{Id: 2, Body: "gone", AuthorId: 1, CreatedAt: createdAt, UpdatedAt: deletedAt, DeletedAt: &deletedAt}},
+	}
+
+	var buf bytes.Buffer
+	writer, _ := newRecordWriter("csv", &buf)
+	for _, record := range records {
+		writer.Write(record)
+	}
+	writer.Flush()
+
+	reader, _ := newRecordReader("csv", &buf)
+	for _, want := range records {
+		got, err := reader.Read()
+		if err != nil {
+			t.Fatalf("error reading CSV: %v", err)
+		}
+		AssertResponseBody(t, got, want)
+	}
+}
+
+func TestCSVReadsHeaderWithoutVersions(t *testing.T) {
+	input := "type,id,email,password_hash,is_chirpy_red,body,author_id,created_at,updated_at\n" +
+		"user,1,user@example.com,hash,false,,,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z\n"
+
+	reader, _ := newRecordReader("csv", strings.NewReader(input))
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatalf("error reading CSV: %v", err)
+	}
+	if record.User == nil || record.User.Email != "user@example.com" || record.User.TokenVersion != 0 {
+		t.Errorf("user from a CSV without token_version, got: %+v", record.User)
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	source := newExportSource(t)
+
+	tests := []struct {
+		name   string
+		filter exportFilter
+		want   int
+	}{
+		{name: "exports only users", filter: exportFilter{entity: "users"}, want: 2},
+		{name: "exports only chirps", filter: exportFilter{entity: "chirps"}, want: 3},
+		{name: "exports deleted chirps when asked", filter: exportFilter{entity: "chirps", includeDeleted: true}, want: 4},
+		{name: "exports one author", filter: exportFilter{entity: "all", authorId: 1}, want: 3},
+		{name: "exports an id range", filter: exportFilter{entity: "chirps", sinceId: 2, untilId: 2}, want: 1},
+		{name: "exports chirps created since a time", filter: exportFilter{entity: "chirps", since: time.Now().Add(time.Hour)}, want: 0},
+		{name: "exports chirps created until a time", filter: exportFilter{entity: "chirps", until: time.Now().Add(time.Hour)}, want: 3},
+		{name: "exports users created since a time", filter: exportFilter{entity: "users", since: time.Now().Add(time.Hour)}, want: 0},
+		{name: "exports users created until a time", filter: exportFilter{entity: "users", until: time.Now().Add(time.Hour)}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, _ := newRecordWriter("jsonl", &buf)
+			written, err := exportRecords(source, writer, tt.filter)
+			if err != nil {
+				t.Fatalf("error exporting: %v", err)
+			}
+
+			AssertResponseBody(t, written, tt.want)
+		})
+	}
+}
+
+func TestExportIncludesAuthors(t *testing.T) {
+	source := newExportSource(t)
+	later, _ := source.GetChirpById(2)
+	later.CreatedAt = time.Now().UTC().Add(2 * time.Hour)
+	putChirp(t, source, later)
+
+	var buf bytes.Buffer
+	writer, _ := newRecordWriter("jsonl", &buf)
+	_, err := exportRecords(source, writer, exportFilter{entity: "all", since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+
+	// The second user was created before since, but wrote the one chirp
+	// after it.
+	target := newTestStore(t)
+	reader, _ := newRecordReader("jsonl", &buf)
+	result, err := importRecords(target, reader, false)
+	if err != nil {
+		t.Fatalf("error importing: %v", err)
+	}
+	AssertResponseBody(t, result, importResult{Users: 1, Chirps: 1})
+	AssertResponseBody(t, storedUsers(t, target)[0].Email, "second@example.com")
+}
+
+func TestImportRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		remapIds bool
+		wantErr  string
+	}{
+		{
+			name:     "rejects an email that already exists",
+			input:    `{"type":"user","user":{"id":1,"email":"taken@example.com"}}` + "\n" + `{"type":"user","user":{"id":7,"email":"new@example.com"}}` + "\n" + `{"type":"chirp","chirp":{"id":1,"body":"moved","author_id":7}}`,
+			remapIds: true,
+			wantErr:  "already exists",
+		},
+		{
+			name:     "rejects an orphaned chirp",
+			input:    `{"type":"chirp","chirp":{"id":9,"body":"orphan","author_id":42}}`,
+			remapIds: false,
+			wantErr:  "orphaned",
+		},
+		{
+			name:     "rejects a taken id",
+			input:    `{"type":"user","user":{"id":1,"email":"other@example.com"}}`,
+			remapIds: false,
+			wantErr:  "already taken",
+		},
+		{
+			name:     "rejects the id of a soft-deleted chirp",
+			input:    `{"type":"chirp","chirp":{"id":2,"body":"reused","author_id":1}}`,
+			remapIds: false,
+			wantErr:  "already taken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTestStore(t)
+			target.CreateUser("taken@example.com", "hash")
+			target.CreateChirp("existing", 1)
+			target.CreateChirp("deleted", 1)
+			target.DeleteChirpById(2)
+
+			reader, _ := newRecordReader("jsonl", strings.NewReader(tt.input))
+			_, err := importRecords(target, reader, tt.remapIds)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("importRecords, got: %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			if users, chirps := storedUsers(t, target), storedChirps(t, target); len(users) != 1 || len(chirps) != 1 {
+				t.Errorf("rejected import changed the store: %d users, %d chirps", len(users), len(chirps))
+			}
+		})
+	}
+}
+
+func TestImportRemapsIds(t *testing.T) {
+	target := newTestStore(t)
+	target.CreateUser("existing@example.com", "hash")
+	target.CreateChirp("existing", 1)
+
+	input := `{"type":"user","user":{"id":1,"email":"new@example.com","is_chirpy_red":true,"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-02-03T04:05:06Z"}}` + "\n" +
+		`{"type":"chirp","chirp":{"id":1,"body":"moved","author_id":1,"created_at":"2024-03-04T05:06:07Z","updated_at":"2024-04-05T06:07:08Z"}}`
+
+	reader, _ := newRecordReader("jsonl", strings.NewReader(input))
+	result, err := importRecords(target, reader, true)
+	if err != nil {
+		t.Fatalf("error importing: %v", err)
+	}
+	AssertResponseBody(t, result, importResult{Users: 1, Chirps: 1})
+
+	user, err := target.GetUserByEmail("new@example.com")
+	if err != nil || user.Id == 1 || !user.IsChirpyRed {
+		t.Fatalf("GetUserByEmail, got: %+v, %v, want a red user with a new id", user, err)
+	}
+	if !user.CreatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) || !user.UpdatedAt.Equal(time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)) {
+		t.Errorf("imported user timestamps, got: %v, %v, want the exported ones", user.CreatedAt, user.UpdatedAt)
+	}
+
+	chirps, _ := target.GetChirpsByAuthor(user.Id)
+	if len(chirps) != 1 {
+		t.Fatalf("GetChirpsByAuthor, got: %+v, want one chirp", chirps)
+	}
+	want := database.Chirp{Id: 2, Body: "moved", AuthorId: user.Id, CreatedAt: time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC), UpdatedAt: time.Date(2024, 4, 5, 6, 7, 8, 0, time.UTC)}
+	AssertResponseBody(t, chirps[0], want)
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+// fakeStore is an in-memory database.HandlerStore for handler tests. It
+// follows the rules of the JSON store, which TestFakeStoreMatchesDB checks,
+// but keeps no log, indexes or events.
+type fakeStore struct {
+	mu                  sync.Mutex
+	lastChirpId         int
+	lastUserId          int
+	lastFamilyId        int
+	chirps              map[int]database.Chirp
+	users               map[int]database.User
+	refreshTokens       map[string]database.RefreshToken
+	revokedAccessTokens map[string]time.Time
+}
+
+var _ database.HandlerStore = (*fakeStore)(nil)
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		chirps:              map[int]database.Chirp{},
+		users:               map[int]database.User{},
+		refreshTokens:       map[string]database.RefreshToken{},
+		revokedAccessTokens: map[string]time.Time{},
+	}
+}
+
+// setChirp stores chirp as given, so handler tests can backdate chirps or
+// soft-delete them at a chosen time.
+func (s *fakeStore) setChirp(chirp database.Chirp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chirps[chirp.Id] = chirp
+}
+
+func (s *fakeStore) CreateChirp(body string, authorId int) (database.Chirp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastChirpId++
+	now := time.Now().UTC()
+	chirp := database.Chirp{Id: s.lastChirpId, Body: body, AuthorId: authorId, CreatedAt: now, UpdatedAt: now}
+	s.chirps[chirp.Id] = chirp
+	return chirp, nil
+}
+
+func (s *fakeStore) ListChirps(query database.ChirpQuery) ([]database.Chirp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// compare orders chirps the way the query does, by id or by creation
+	// time with ties broken by id.
+	compare := func(a, b database.Chirp) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); query.ByCreatedAt && c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Id, b.Id)
+	}
+	after := database.Chirp{Id: query.AfterId, CreatedAt: query.AfterCreatedAt}
+
+	chirps := []database.Chirp{}
+	for _, chirp := range s.chirps {
+		if (chirp.DeletedAt != nil && !query.IncludeDeleted) || (query.AuthorId != 0 && chirp.AuthorId != query.AuthorId) {
+			continue
+		}
+		if !query.Since.IsZero() && chirp.CreatedAt.Before(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && !chirp.CreatedAt.Before(query.Until) {
+			continue
+		}
+		if query.AfterId != 0 && (query.Descending && compare(chirp, after) >= 0 || !query.Descending && compare(chirp, after) <= 0) {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	slices.SortFunc(chirps, compare)
+	if query.Descending {
+		slices.Reverse(chirps)
+	}
+	if query.Limit != 0 && len(chirps) > query.Limit {
+		chirps = chirps[:query.Limit]
+	}
+	return chirps, nil
+}
+
+func (s *fakeStore) GetChirpById(chirpId int) (database.Chirp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chirp, ok := s.chirps[chirpId]
+	if !ok || chirp.DeletedAt != nil {
+		return database.Chirp{}, database.ErrChirpDoesNotExist
+	}
+	return chirp, nil
+}
+
+func (s *fakeStore) DeleteChirpById(chirpId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chirp, ok := s.chirps[chirpId]
+	if ok && chirp.DeletedAt == nil {
+		deletedAt := time.Now().UTC()
+		chirp.DeletedAt = &deletedAt
+		chirp.UpdatedAt = deletedAt
+		s.chirps[chirpId] = chirp
+	}
+	return nil
+}
+
+func (s *fakeStore) GetDeletedChirpById(chirpId int) (database.Chirp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chirp, ok := s.chirps[chirpId]
+	if !ok || chirp.DeletedAt == nil {
+		return database.Chirp{}, database.ErrChirpDoesNotExist
+	}
+	return chirp, nil
+}
+
+func (s *fakeStore) RestoreChirpById(chirpId int) (database.Chirp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chirp, ok := s.chirps[chirpId]
+	if !ok || chirp.DeletedAt == nil {
+		return database.Chirp{}, database.ErrChirpDoesNotExist
+	}
+	chirp.DeletedAt = nil
+	chirp.UpdatedAt = time.Now().UTC()
+	s.chirps[chirpId] = chirp
+	return chirp, nil
+}
+
+func (s *fakeStore) CreateUser(email, passwordHash string) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByEmail(email); ok {
+		return database.User{}, database.ErrUserAlreadyExists
+	}
+
+	s.lastUserId++
+	now := time.Now().UTC()
+	user := database.User{Id: s.lastUserId, Email: email, PasswordHash: passwordHash, CreatedAt: now, UpdatedAt: now}
+	s.users[user.Id] = user
+	return user, nil
+}
+
+func (s *fakeStore) userByEmail(email string) (database.User, bool) {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+	return database.User{}, false
+}
+
+func (s *fakeStore) GetUserById(userId int) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return database.User{}, database.ErrUserDoesNotExist
+	}
+	return user, nil
+}
+
+func (s *fakeStore) GetUserByEmail(email string) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.userByEmail(email)
+	if !ok {
+		return database.User{}, database.ErrUserDoesNotExist
+	}
+	return user, nil
+}
+
+func (s *fakeStore) UpdateUserEmailPasswordById(userId int, email, passwordHash string) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return database.User{}, database.ErrUserDoesNotExist
+	}
+	if owner, ok := s.userByEmail(email); ok && owner.Id != userId {
+		return database.User{}, database.ErrUserAlreadyExists
+	}
+
+	if user.PasswordHash != passwordHash {
+		user.TokenVersion++
+		s.revokeRefreshTokensByUser(userId)
+	}
+	user.Email = email
+	user.PasswordHash = passwordHash
+	user.UpdatedAt = time.Now().UTC()
+	s.users[userId] = user
+	return user, nil
+}
+
+func (s *fakeStore) UpgradeUserToRedByUserId(userId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return database.ErrUserDoesNotExist
+	}
+	if !user.IsChirpyRed {
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		s.users[userId] = user
+	}
+	return nil
+}
+
+func (s *fakeStore) RevokeSessionsByUser(userId int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return 0, database.ErrUserDoesNotExist
+	}
+	revoked := s.revokeRefreshTokensByUser(userId)
+	user.TokenVersion++
+	user.UpdatedAt = time.Now().UTC()
+	s.users[userId] = user
+	return revoked, nil
+}
+
+func (s *fakeStore) revokeRefreshTokensByUser(userId int) int {
+	now := time.Now().UTC()
+	revoked := 0
+	for tokenHash, refreshToken := range s.refreshTokens {
+		if refreshToken.UserId == userId {
+			if refreshToken.IsSession(now) {
+				revoked++
+			}
+			delete(s.refreshTokens, tokenHash)
+		}
+	}
+	return revoked
+}
+
+// revokeRefreshTokenFamily deletes the user's tokens in familyId and returns
+// how many there were.
+func (s *fakeStore) revokeRefreshTokenFamily(userId int, familyId string) int {
+	revoked := 0
+	for tokenHash, refreshToken := range s.refreshTokens {
+		if refreshToken.UserId == userId && refreshToken.FamilyId == familyId {
+			delete(s.refreshTokens, tokenHash)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func hashFakeRefreshToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+func (s *fakeStore) CreateRefreshToken(userId int, token string, expiresAt time.Time, client database.Client) (database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastFamilyId++
+	now := time.Now().UTC()
+	refreshToken := database.RefreshToken{
+		UserId:     userId,
+		TokenHash:  hashFakeRefreshToken(token),
+		FamilyId:   "family-" + strconv.Itoa(s.lastFamilyId),
+		ExpiresAt:  expiresAt,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	s.refreshTokens[refreshToken.TokenHash] = refreshToken
+	return refreshToken, nil
+}
+
+func (s *fakeStore) RotateRefreshToken(token, newToken string, expiresAt time.Time, client database.Client) (database.User, database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refreshToken, ok := s.refreshTokens[hashFakeRefreshToken(token)]
+	if !ok {
+		return database.User{}, database.RefreshToken{}, database.ErrRefreshTokenDoesNotExist
+	}
+
+	if refreshToken.RotatedAt != nil {
+		s.revokeRefreshTokenFamily(refreshToken.UserId, refreshToken.FamilyId)
+		return database.User{}, refreshToken, database.ErrRefreshTokenReused
+	}
+
+	now := time.Now().UTC()
+	if refreshToken.ExpiresAt.Before(now) {
+		return database.User{}, database.RefreshToken{}, database.ErrRefreshTokenExpired
+	}
+
+	user, ok := s.users[refreshToken.UserId]
+	if !ok {
+		return database.User{}, database.RefreshToken{}, database.ErrUserDoesNotExist
+	}
+
+	refreshToken.RotatedAt = &now
+	s.refreshTokens[refreshToken.TokenHash] = refreshToken
+
+	rotated := database.RefreshToken{
+		UserId:     user.Id,
+		TokenHash:  hashFakeRefreshToken(newToken),
+		FamilyId:   refreshToken.FamilyId,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  refreshToken.CreatedAt,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	s.refreshTokens[rotated.TokenHash] = rotated
+	return user, rotated, nil
+}
+
+func (s *fakeStore) DeleteRefreshToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.refreshTokens, hashFakeRefreshToken(token))
+	return nil
+}
+
+func (s *fakeStore) RevokeRefreshTokenFamily(userId int, familyId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.revokeRefreshTokenFamily(userId, familyId) == 0 {
+		return database.ErrRefreshTokenDoesNotExist
+	}
+	return nil
+}
+
+func (s *fakeStore) IsRefreshTokenFamilyActive(userId int, familyId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, refreshToken := range s.refreshTokens {
+		if refreshToken.UserId == userId && refreshToken.FamilyId == familyId && refreshToken.RotatedAt == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *fakeStore) GetUserAndRefreshTokenByRefreshToken(token string) (database.User, database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refreshToken, ok := s.refreshTokens[hashFakeRefreshToken(token)]
+	if !ok {
+		return database.User{}, database.RefreshToken{}, database.ErrRefreshTokenDoesNotExist
+	}
+	user, ok := s.users[refreshToken.UserId]
+	if !ok {
+		return database.User{}, database.RefreshToken{}, database.ErrUserDoesNotExist
+	}
+	return user, refreshToken, nil
+}
+
+func (s *fakeStore) GetRefreshTokensByUser(userId int) ([]database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refreshTokens := []database.RefreshToken{}
+	for _, refreshToken := range s.refreshTokens {
+		if refreshToken.UserId == userId {
+			refreshTokens = append(refreshTokens, refreshToken)
+		}
+	}
+	return refreshTokens, nil
+}
+
+func (s *fakeStore) RevokeAccessToken(id string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokedAccessTokens[id] = expiresAt
+	return nil
+}
+
+func (s *fakeStore) IsAccessTokenRevoked(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revokedAccessTokens[id]
+	return ok, nil
+}
+
+// TestFakeStoreMatchesDB runs the same calls against the fake and the JSON
+// store, so the fake can't drift from the rules the handlers rely on.
+func TestFakeStoreMatchesDB(t *testing.T) {
+	record := func(store database.HandlerStore) []string {
+		log := []string{}
+		note := func(format string, args ...any) {
+			log = append(log, fmt.Sprintf(format, args...))
+		}
+		chirpIds := func(chirps []database.Chirp, err error) string {
+			ids := []int{}
+			for _, chirp := range chirps {
+				ids = append(ids, chirp.Id)
+			}
+			return fmt.Sprint(ids, err)
+		}
+		expiresAt := time.Now().Add(time.Hour)
+
+		owner, err := store.CreateUser("owner@example.com", "hash")
+		note("create user: %d %v", owner.Id, err)
+		_, err = store.CreateUser("owner@example.com", "hash")
+		note("create duplicate user: %v", err)
+		other, _ := store.CreateUser("other@example.com", "hash")
+		_, err = store.UpdateUserEmailPasswordById(other.Id, "owner@example.com", "hash")
+		note("take another user's email: %v", err)
+		_, err = store.GetUserByEmail("missing@example.com")
+		note("get missing user: %v", err)
+		note("upgrade missing user: %v", store.UpgradeUserToRedByUserId(99))
+
+		for _, body := range []string{"one", "two", "three", "four"} {
+			store.CreateChirp(body, owner.Id)
+		}
+		store.CreateChirp("theirs", other.Id)
+		note("delete chirp: %v", store.DeleteChirpById(2))
+		note("delete deleted chirp: %v", store.DeleteChirpById(2))
+		_, err = store.GetChirpById(2)
+		note("get deleted chirp: %v", err)
+		_, err = store.RestoreChirpById(3)
+		note("restore live chirp: %v", err)
+		note("list: %s", chirpIds(store.ListChirps(database.ChirpQuery{})))
+		note("list author: %s", chirpIds(store.ListChirps(database.ChirpQuery{AuthorId: owner.Id, Limit: 2})))
+		note("list after: %s", chirpIds(store.ListChirps(database.ChirpQuery{AfterId: 2, Limit: 2})))
+		note("list descending after: %s", chirpIds(store.ListChirps(database.ChirpQuery{AfterId: 4, Descending: true})))
+		note("list descending: %s", chirpIds(store.ListChirps(database.ChirpQuery{Descending: true, Limit: 3})))
+		note("list by creation: %s", chirpIds(store.ListChirps(database.ChirpQuery{ByCreatedAt: true, Descending: true, Limit: 3})))
+		chirp, err := store.RestoreChirpById(2)
+		note("restore chirp: %d %v %v", chirp.Id, chirp.DeletedAt, err)
+
+		session, _ := store.CreateRefreshToken(owner.Id, "first", expiresAt, database.Client{})
+		_, rotated, err := store.RotateRefreshToken("first", "second", expiresAt, database.Client{UserAgent: "test"})
+		note("rotate: %v %v %v", rotated.FamilyId == session.FamilyId, rotated.UserAgent, err)
+		active, _ := store.IsRefreshTokenFamilyActive(owner.Id, session.FamilyId)
+		note("family active: %v", active)
+		_, _, err = store.RotateRefreshToken("first", "third", expiresAt, database.Client{})
+		note("reuse: %v", err)
+		active, _ = store.IsRefreshTokenFamilyActive(owner.Id, session.FamilyId)
+		note("family active after reuse: %v", active)
+		note("revoke revoked family: %v", store.RevokeRefreshTokenFamily(owner.Id, session.FamilyId))
+
+		store.CreateRefreshToken(owner.Id, "expired", time.Now().Add(-time.Hour), database.Client{})
+		_, _, err = store.RotateRefreshToken("expired", "fourth", expiresAt, database.Client{})
+		note("rotate expired: %v", err)
+		store.CreateRefreshToken(owner.Id, "fifth", expiresAt, database.Client{})
+		refreshTokens, _ := store.GetRefreshTokensByUser(owner.Id)
+		note("sessions: %d", len(refreshTokens))
+		user, _ := store.UpdateUserEmailPasswordById(owner.Id, "owner@example.com", "new hash")
+		note("change password: version %d", user.TokenVersion)
+		_, _, err = store.GetUserAndRefreshTokenByRefreshToken("fifth")
+		note("token after password change: %v", err)
+
+		store.CreateRefreshToken(owner.Id, "sixth", expiresAt, database.Client{})
+		revoked, err := store.RevokeSessionsByUser(owner.Id)
+		user, _ = store.GetUserById(owner.Id)
+		note("revoke sessions: %d %v version %d", revoked, err, user.TokenVersion)
+		note("delete missing token: %v", store.DeleteRefreshToken("missing"))
+
+		store.RevokeAccessToken("jti", expiresAt)
+		revokedJti, _ := store.IsAccessTokenRevoked("jti")
+		otherJti, _ := store.IsAccessTokenRevoked("other")
+		note("access tokens: %v %v", revokedJti, otherJti)
+		return log
+	}
+
+	want := record(newTestStore(t))
+	got := record(newFakeStore())
+	if !slices.Equal(got, want) {
+		t.Errorf("fake store, got:\n%s\nwant, as the JSON store:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
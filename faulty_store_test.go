@@ -0,0 +1,305 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+type faultKind int
+
+const (
+	// faultLatency delays the operation, which then runs normally.
+	faultLatency faultKind = iota
+	// faultFail fails the operation without running it.
+	faultFail
+	// faultPartialWrite runs the write and then reports it failed, as when
+	// a commit lands but its acknowledgement is lost.
+	faultPartialWrite
+	// faultCorruptRead fails a read the way a database that can't be
+	// decoded does.
+	faultCorruptRead
+)
+
+type fault struct {
+	kind  faultKind
+	delay time.Duration
+}
+
+// faultyStore wraps a Store and injects faults into named operations, such
+// as "CreateChirp". Operations without a fault pass straight through.
+type faultyStore struct {
+	database.Store
+
+	mu     sync.Mutex
+	faults map[string]fault
+}
+
+var _ database.Store = (*faultyStore)(nil)
+
+func newFaultyStore(store database.Store) *faultyStore {
+	return &faultyStore{Store: store, faults: map[string]fault{}}
+}
+
+func (s *faultyStore) inject(op string, f fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[op] = f
+}
+
+func (s *faultyStore) fault(op string) (fault, bool) {
+	s.mu.Lock()
+	f, ok := s.faults[op]
+	s.mu.Unlock()
+
+	if ok && f.kind == faultLatency {
+		time.Sleep(f.delay)
+		return fault{}, false
+	}
+	return f, ok
+}
+
+func faultyRead[T any](s *faultyStore, op string, call func() (T, error)) (T, error) {
+	var zero T
+
+	f, ok := s.fault(op)
+	if ok && f.kind == faultCorruptRead {
+		return zero, database.ErrDatabaseCorrupt
+	}
+	if ok {
+		return zero, database.ErrDatabaseLoad
+	}
+	return call()
+}
+
+func faultyWrite[T any](s *faultyStore, op string, call func() (T, error)) (T, error) {
+	var zero T
+
+	f, ok := s.fault(op)
+	if ok && f.kind == faultPartialWrite {
+		call()
+		return zero, database.ErrDatabaseWrite
+	}
+	if ok {
+		return zero, database.ErrDatabaseWrite
+	}
+	return call()
+}
+
+func noResult(call func() error) func() (struct{}, error) {
+	return func() (struct{}, error) {
+		return struct{}{}, call()
+	}
+}
+
+func (s *faultyStore) CreateChirp(body string, authorId int) (database.Chirp, error) {
+	return faultyWrite(s, "CreateChirp", func() (database.Chirp, error) {
+		return s.Store.CreateChirp(body, authorId)
+	})
+}
+
+func (s *faultyStore) GetChirps() ([]database.Chirp, error) {
+	return faultyRead(s, "GetChirps", s.Store.GetChirps)
+}
+
+func (s *faultyStore) GetChirpsByAuthor(authorId int) ([]database.Chirp, error) {
+	return faultyRead(s, "GetChirpsByAuthor", func() ([]database.Chirp, error) {
+		return s.Store.GetChirpsByAuthor(authorId)
+	})
+}
+
+func (s *faultyStore) ListChirps(query database.ChirpQuery) ([]database.Chirp, error) {
+	return faultyRead(s, "ListChirps", func() ([]database.Chirp, error) {
+		return s.Store.ListChirps(query)
+	})
+}
+
+func (s *faultyStore) GetChirpById(chirpId int) (database.Chirp, error) {
+	return faultyRead(s, "GetChirpById", func() (database.Chirp, error) {
+		return s.Store.GetChirpById(chirpId)
+	})
+}
+
+func (s *faultyStore) DeleteChirpById(chirpId int) error {
+	_, err := faultyWrite(s, "DeleteChirpById", noResult(func() error {
+		return s.Store.DeleteChirpById(chirpId)
+	}))
+	return err
+}
+
+func (s *faultyStore) GetDeletedChirpById(chirpId int) (database.Chirp, error) {
+	return faultyRead(s, "GetDeletedChirpById", func() (database.Chirp, error) {
+		return s.Store.GetDeletedChirpById(chirpId)
+	})
+}
+
+func (s *faultyStore) RestoreChirpById(chirpId int) (database.Chirp, error) {
+	return faultyWrite(s, "RestoreChirpById", func() (database.Chirp, error) {
+		return s.Store.RestoreChirpById(chirpId)
+	})
+}
+
+func (s *faultyStore) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	return faultyWrite(s, "PurgeDeletedChirps", func() (int, error) {
+		return s.Store.PurgeDeletedChirps(cutoff)
+	})
+}
+
+func (s *faultyStore) CreateUser(email, passwordHash string) (database.User, error) {
+	return faultyWrite(s, "CreateUser", func() (database.User, error) {
+		return s.Store.CreateUser(email, passwordHash)
+	})
+}
+
+func (s *faultyStore) GetUsers() ([]database.User, error) {
+	return faultyRead(s, "GetUsers", s.Store.GetUsers)
+}
+
+func (s *faultyStore) GetUserById(userId int) (database.User, error) {
+	return faultyRead(s, "GetUserById", func() (database.User, error) {
+		return s.Store.GetUserById(userId)
+	})
+}
+
+func (s *faultyStore) GetUserByEmail(email string) (database.User, error) {
+	return faultyRead(s, "GetUserByEmail", func() (database.User, error) {
+		return s.Store.GetUserByEmail(email)
+	})
+}
+
+func (s *faultyStore) UpdateUserEmailPasswordById(userId int, email, passwordHash string) (database.User, error) {
+	return faultyWrite(s, "UpdateUserEmailPasswordById", func() (database.User, error) {
+		return s.Store.UpdateUserEmailPasswordById(userId, email, passwordHash)
+	})
+}
+
+func (s *faultyStore) UpgradeUserToRedByUserId(userId int) error {
+	_, err := faultyWrite(s, "UpgradeUserToRedByUserId", noResult(func() error {
+		return s.Store.UpgradeUserToRedByUserId(userId)
+	}))
+	return err
+}
+
+func (s *faultyStore) CreateRefreshToken(userId int, token string, expiresAt time.Time, client database.Client) (database.RefreshToken, error) {
+	return faultyWrite(s, "CreateRefreshToken", func() (database.RefreshToken, error) {
+		return s.Store.CreateRefreshToken(userId, token, expiresAt, client)
+	})
+}
+
+func (s *faultyStore) DeleteRefreshToken(token string) error {
+	_, err := faultyWrite(s, "DeleteRefreshToken", noResult(func() error {
+		return s.Store.DeleteRefreshToken(token)
+	}))
+	return err
+}
+
+func (s *faultyStore) RotateRefreshToken(token, newToken string, expiresAt time.Time, client database.Client) (database.User, database.RefreshToken, error) {
+	var refreshToken database.RefreshToken
+
+	user, err := faultyWrite(s, "RotateRefreshToken", func() (database.User, error) {
+		var user database.User
+		var err error
+		user, refreshToken, err = s.Store.RotateRefreshToken(token, newToken, expiresAt, client)
+		return user, err
+	})
+	if err != nil {
+		return database.User{}, database.RefreshToken{}, err
+	}
+	return user, refreshToken, nil
+}
+
+func (s *faultyStore) RevokeRefreshTokenFamily(userId int, familyId string) error {
+	_, err := faultyWrite(s, "RevokeRefreshTokenFamily", noResult(func() error {
+		return s.Store.RevokeRefreshTokenFamily(userId, familyId)
+	}))
+	return err
+}
+
+func (s *faultyStore) RevokeSessionsByUser(userId int) (int, error) {
+	return faultyWrite(s, "RevokeSessionsByUser", func() (int, error) {
+		return s.Store.RevokeSessionsByUser(userId)
+	})
+}
+
+func (s *faultyStore) IsRefreshTokenFamilyActive(userId int, familyId string) (bool, error) {
+	return faultyRead(s, "IsRefreshTokenFamilyActive", func() (bool, error) {
+		return s.Store.IsRefreshTokenFamilyActive(userId, familyId)
+	})
+}
+
+func (s *faultyStore) RevokeAccessToken(id string, expiresAt time.Time) error {
+	_, err := faultyWrite(s, "RevokeAccessToken", noResult(func() error {
+		return s.Store.RevokeAccessToken(id, expiresAt)
+	}))
+	return err
+}
+
+func (s *faultyStore) IsAccessTokenRevoked(id string) (bool, error) {
+	return faultyRead(s, "IsAccessTokenRevoked", func() (bool, error) {
+		return s.Store.IsAccessTokenRevoked(id)
+	})
+}
+
+func (s *faultyStore) PurgeRevokedAccessTokens(cutoff time.Time) (int, error) {
+	return faultyWrite(s, "PurgeRevokedAccessTokens", func() (int, error) {
+		return s.Store.PurgeRevokedAccessTokens(cutoff)
+	})
+}
+
+func (s *faultyStore) GetUserAndRefreshTokenByRefreshToken(token string) (database.User, database.RefreshToken, error) {
+	var refreshToken database.RefreshToken
+
+	user, err := faultyRead(s, "GetUserAndRefreshTokenByRefreshToken", func() (database.User, error) {
+		var user database.User
+		var err error
+		user, refreshToken, err = s.Store.GetUserAndRefreshTokenByRefreshToken(token)
+		return user, err
+	})
+	if err != nil {
+		return database.User{}, database.RefreshToken{}, err
+	}
+	return user, refreshToken, nil
+}
+
+func (s *faultyStore) GetRefreshTokensByUser(userId int) ([]database.RefreshToken, error) {
+	return faultyRead(s, "GetRefreshTokensByUser", func() ([]database.RefreshToken, error) {
+		return s.Store.GetRefreshTokensByUser(userId)
+	})
+}
+
+func (s *faultyStore) PurgeExpiredRefreshTokens(cutoff time.Time) (int, error) {
+	return faultyWrite(s, "PurgeExpiredRefreshTokens", func() (int, error) {
+		return s.Store.PurgeExpiredRefreshTokens(cutoff)
+	})
+}
+
+func (s *faultyStore) Import(users []database.User, chirps []database.Chirp, remapIds bool) error {
+	_, err := faultyWrite(s, "Import", noResult(func() error {
+		return s.Store.Import(users, chirps, remapIds)
+	}))
+	return err
+}
+
+func (s *faultyStore) Apply(event database.Event) error {
+	_, err := faultyWrite(s, "Apply", noResult(func() error {
+		return s.Store.Apply(event)
+	}))
+	return err
+}
+
+func (s *faultyStore) Backup(w io.Writer) error {
+	_, err := faultyRead(s, "Backup", noResult(func() error {
+		return s.Store.Backup(w)
+	}))
+	return err
+}
+
+func (s *faultyStore) Restore(r io.Reader) error {
+	_, err := faultyWrite(s, "Restore", noResult(func() error {
+		return s.Store.Restore(r)
+	}))
+	return err
+}
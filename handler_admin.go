@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+func (api *apiConfig) postBackup(w http.ResponseWriter, r *http.Request) {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil || api.adminApiKey == "" || apiKey != api.adminApiKey {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	path, err := writeBackup(api.admin.Backup, api.backupDir)
+	if err != nil {
+		log.Printf("Error writing backup: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Backup failed")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, struct {
+		Path string `json:"path"`
+	}{
+		Path: path,
+	})
+}
+
+// getBackup sends a snapshot to the client rather than writing it on the
+// server, for backups taken from another machine or directory.
+func (api *apiConfig) getBackup(w http.ResponseWriter, r *http.Request) {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil || api.adminApiKey == "" || apiKey != api.adminApiKey {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	// Taking the whole snapshot first means a failure can still be
+	// reported, rather than leaving the client a truncated file.
+	var snapshot bytes.Buffer
+	err = api.admin.Backup(&snapshot)
+	if err != nil {
+		log.Printf("Error taking backup snapshot: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Backup failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(snapshot.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(snapshot.Bytes())
+}
+
+func (api *apiConfig) getReplication(w http.ResponseWriter, r *http.Request) {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil || api.adminApiKey == "" || apiKey != api.adminApiKey {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	// Subscribing before taking the snapshot means no change falls between
+	// the two; changes already in the snapshot are replayed harmlessly.
+	events, unsubscribe := api.replication.Subscribe(replicationBuffer)
+	defer unsubscribe()
+
+	var snapshot bytes.Buffer
+	err = api.replication.Backup(&snapshot)
+	if err != nil {
+		log.Printf("Error taking replication snapshot: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Snapshot failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(replicationMessage{Snapshot: snapshot.Bytes()})
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			// A dropped subscription or a restore ends the stream, and the
+			// replica resyncs from a new snapshot.
+			if !ok || event.Type == database.DatabaseRestored {
+				return
+			}
+
+			err = encoder.Encode(replicationMessage{Event: &event})
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (api *apiConfig) postSearchReindex(w http.ResponseWriter, r *http.Request) {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil || api.adminApiKey == "" || apiKey != api.adminApiKey {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	err = api.search.Reindex(r.Context())
+	if err != nil {
+		log.Printf("Error rebuilding search index: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Reindex failed")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Chirps int `json:"chirps"`
+	}{
+		Chirps: api.search.index.Len(),
+	})
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"sort"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/iamhectorsosa/web-server/internal/auth"
 	database "github.com/iamhectorsosa/web-server/internal/database"
@@ -26,37 +29,80 @@ func (api *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 
 	sortQ := r.URL.Query().Get("sort")
 
-	if sortQ != "asc" && sortQ != "desc" {
+	if sortQ != "asc" && sortQ != "desc" && sortQ != "created_at" && sortQ != "-created_at" {
 		sortQ = ""
 	}
 
-	dbChirps, err := api.DB.GetChirps()
+	since, err := parseTimeQuery(r, "since")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid since timestamp")
+		return
+	}
+
+	until, err := parseTimeQuery(r, "until")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid until timestamp")
+		return
+	}
+
+	limit, err := parseLimitQuery(r, defaultChirpsLimit)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+
+	byCreatedAt := sortQ == "created_at" || sortQ == "-created_at"
+
+	// Every cursor handed out points past a chirp, so one without an id
+	// wasn't made here.
+	cursor := chirpCursor{}
+	err = parseCursorQuery(r, &cursor)
+	if err != nil || r.URL.Query().Get("cursor") != "" && (cursor.AfterId < 1 || byCreatedAt && cursor.CreatedAt == nil) {
+		respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
 
+	query := database.ChirpQuery{
+		AuthorId:    authorId,
+		Descending:  sortQ == "desc" || sortQ == "-created_at",
+		ByCreatedAt: byCreatedAt,
+		AfterId:     cursor.AfterId,
+		Since:       since,
+		Until:       until,
+		// One chirp past the page tells us whether there's a next one.
+		Limit: limit + 1,
+	}
+	if byCreatedAt && cursor.CreatedAt != nil {
+		query.AfterCreatedAt = *cursor.CreatedAt
+	}
+
+	dbChirps, err := api.DB.ListChirps(query)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve Chirps")
 		return
 	}
 
-	chirps := []database.Chirp{}
-	for _, dbChirp := range dbChirps {
-		if authorId != 0 && dbChirp.AuthorId != authorId {
-			continue
+	if len(dbChirps) > limit {
+		dbChirps = dbChirps[:limit]
+		last := dbChirps[limit-1]
+		next := chirpCursor{AfterId: last.Id}
+		if byCreatedAt {
+			next.CreatedAt = &last.CreatedAt
 		}
+		w.Header().Set("Link", nextPageLink(r, next))
+	}
 
+	chirps := []database.Chirp{}
+	for _, dbChirp := range dbChirps {
 		chirps = append(chirps, database.Chirp{
-			Id:       dbChirp.Id,
-			AuthorId: dbChirp.AuthorId,
-			Body:     dbChirp.Body,
+			Id:        dbChirp.Id,
+			AuthorId:  dbChirp.AuthorId,
+			Body:      dbChirp.Body,
+			CreatedAt: dbChirp.CreatedAt,
+			UpdatedAt: dbChirp.UpdatedAt,
 		})
 	}
 
-	sort.Slice(chirps, func(i, j int) bool {
-		if sortQ == "desc" {
-			return chirps[i].Id > chirps[j].Id
-		}
-		return chirps[i].Id < chirps[j].Id
-	})
-
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
@@ -71,11 +117,16 @@ func (api *apiConfig) getChirpById(w http.ResponseWriter, r *http.Request) {
 
 	chirps, err := api.DB.GetChirpById(chirpId)
 
-	if err != nil {
+	if err == database.ErrChirpDoesNotExist {
 		respondWithError(w, http.StatusNotFound, "Something went wrong")
 		return
 	}
 
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve Chirp")
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
@@ -86,9 +137,9 @@ func (api *apiConfig) postChirps(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId, err := auth.ValidateJWT(authToken, api.jwtSecret)
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		respondWithJWTError(w, err)
 		return
 	}
 
@@ -145,9 +196,9 @@ func (api *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId, err := auth.ValidateJWT(authToken, api.jwtSecret)
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		respondWithJWTError(w, err)
 		return
 	}
 
@@ -161,11 +212,16 @@ func (api *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
 
 	chirp, err := api.DB.GetChirpById(chirpId)
 
-	if err != nil {
+	if err == database.ErrChirpDoesNotExist {
 		respondWithError(w, http.StatusNotFound, "Something went wrong")
 		return
 	}
 
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve Chirp")
+		return
+	}
+
 	if chirp.AuthorId != userId {
 		respondWithError(w, http.StatusForbidden, "Cannot delete others Chirps")
 		return
@@ -180,3 +236,126 @@ func (api *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (api *apiConfig) postChirpRestore(w http.ResponseWriter, r *http.Request) {
+	authToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	chirpId, err := strconv.Atoi(id)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID")
+		return
+	}
+
+	chirp, err := api.DB.GetDeletedChirpById(chirpId)
+
+	if err == database.ErrChirpDoesNotExist {
+		respondWithError(w, http.StatusNotFound, "Something went wrong")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve Chirp")
+		return
+	}
+
+	if chirp.AuthorId != userId {
+		respondWithError(w, http.StatusForbidden, "Cannot restore others Chirps")
+		return
+	}
+
+	if time.Since(*chirp.DeletedAt) > api.chirpRestoreWindow {
+		respondWithError(w, http.StatusGone, "Chirp can no longer be restored")
+		return
+	}
+
+	chirp, err = api.DB.RestoreChirpById(chirpId)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// defaultChirpsLimit is the page size of GET /api/chirps without a limit,
+// and maxChirpsLimit the largest a client can ask for.
+const (
+	defaultChirpsLimit = 50
+	maxChirpsLimit     = 100
+)
+
+// chirpCursor marks where the next page of GET /api/chirps starts. Pages in
+// creation order carry the last chirp's creation time too.
+type chirpCursor struct {
+	AfterId   int        `json:"after_id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// parseLimitQuery reads the limit query parameter, returning defaultLimit
+// when it's absent.
+func parseLimitQuery(r *http.Request, defaultLimit int) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 || limit > maxChirpsLimit {
+		return 0, fmt.Errorf("limit %d is out of range", limit)
+	}
+	return limit, nil
+}
+
+// parseCursorQuery decodes the opaque cursor query parameter into cursor,
+// leaving it untouched when the parameter is absent.
+func parseCursorQuery(r *http.Request, cursor any) error {
+	value := r.URL.Query().Get("cursor")
+	if value == "" {
+		return nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, cursor)
+}
+
+// nextPageLink is a Link header pointing at the page cursor describes,
+// keeping the rest of the request's query.
+func nextPageLink(r *http.Request, cursor any) string {
+	data, _ := json.Marshal(cursor)
+
+	query := r.URL.Query()
+	query.Set("cursor", base64.RawURLEncoding.EncodeToString(data))
+
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf("<%s>; rel=\"next\"", next.String())
+}
+
+// parseTimeQuery reads an RFC 3339 timestamp from the query parameter name,
+// returning the zero time when it's absent.
+func parseTimeQuery(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
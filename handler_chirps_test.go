@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+var testJWTKeys, _ = auth.NewKeyring(auth.NewHMACKey("test", []byte("test-secret")))
+
+func TestGetChirps(t *testing.T) {
+	store := newFakeStore()
+	store.CreateChirp("first", 1)
+	store.CreateChirp("second", 2)
+	store.CreateChirp("third", 1)
+
+	base := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for id, offset := range map[int]time.Duration{1: 2 * time.Hour, 2: 0, 3: time.Hour} {
+		chirp, _ := store.GetChirpById(id)
+		chirp.CreatedAt = base.Add(offset)
+		store.setChirp(chirp)
+	}
+	api := apiConfig{DB: store, jwtKeys: testJWTKeys}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		{name: "returns all chirps ascending", query: "", want: []int{1, 2, 3}},
+		{name: "returns all chirps descending", query: "?sort=desc", want: []int{3, 2, 1}},
+		{name: "filters chirps by author", query: "?author_id=1", want: []int{1, 3}},
+		{name: "sorts chirps by creation time", query: "?sort=created_at", want: []int{2, 3, 1}},
+		{name: "sorts chirps by creation time descending", query: "?sort=-created_at", want: []int{1, 3, 2}},
+		{name: "filters chirps created since a time", query: "?since=2024-05-01T13:00:00Z", want: []int{1, 3}},
+		{name: "filters chirps created until a time", query: "?until=2024-05-01T13:00:00Z", want: []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/chirps"+tt.query, nil)
+			response := httptest.NewRecorder()
+			api.getChirps(response, request)
+
+			var chirps []database.Chirp
+			err := json.NewDecoder(response.Body).Decode(&chirps)
+			if err != nil {
+				t.Fatalf("error decoding JSON response: %v", err)
+			}
+
+			got := []int{}
+			for _, chirp := range chirps {
+				got = append(got, chirp.Id)
+			}
+
+			AssertResponseBody(t, got, tt.want)
+			AssertResponseCode(t, response.Code, http.StatusOK)
+		})
+	}
+}
+
+func TestGetChirpsPagination(t *testing.T) {
+	store := newFakeStore()
+	for _, authorId := range []int{1, 2, 1, 1, 2} {
+		store.CreateChirp("chirp", authorId)
+	}
+
+	// Creation order is 4 and 5 together, 2, 3, then 1.
+	base := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for id, offset := range map[int]time.Duration{1: 3 * time.Hour, 2: time.Hour, 3: 2 * time.Hour, 4: 0, 5: 0} {
+		chirp, _ := store.GetChirpById(id)
+		chirp.CreatedAt = base.Add(offset)
+		store.setChirp(chirp)
+	}
+	api := apiConfig{DB: store}
+
+	tests := []struct {
+		name  string
+		query string
+		want  [][]int
+	}{
+		{name: "pages ascending", query: "?limit=2", want: [][]int{{1, 2}, {3, 4}, {5}}},
+		{name: "pages descending", query: "?limit=2&sort=desc", want: [][]int{{5, 4}, {3, 2}, {1}}},
+		{name: "pages one author", query: "?limit=2&author_id=1", want: [][]int{{1, 3}, {4}}},
+		{name: "ends without a link on an exact page", query: "?limit=5", want: [][]int{{1, 2, 3, 4, 5}}},
+		{name: "pages by creation time", query: "?limit=2&sort=created_at", want: [][]int{{4, 5}, {2, 3}, {1}}},
+		{name: "pages by creation time descending", query: "?limit=2&sort=-created_at", want: [][]int{{1, 3}, {2, 5}, {4}}},
+		{name: "pages one author by creation time", query: "?limit=1&sort=created_at&author_id=2", want: [][]int{{5}, {2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/api/chirps" + tt.query
+			got := [][]int{}
+
+			for target != "" {
+				request := httptest.NewRequest(http.MethodGet, target, nil)
+				response := httptest.NewRecorder()
+				api.getChirps(response, request)
+				AssertResponseCode(t, response.Code, http.StatusOK)
+
+				var chirps []database.Chirp
+				err := json.NewDecoder(response.Body).Decode(&chirps)
+				if err != nil {
+					t.Fatalf("error decoding JSON response: %v", err)
+				}
+
+				page := []int{}
+				for _, chirp := range chirps {
+					page = append(page, chirp.Id)
+				}
+				got = append(got, page)
+
+				target = ""
+				if link := response.Header().Get("Link"); link != "" {
+					target = strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<")
+				}
+				if len(got) > len(tt.want) {
+					t.Fatalf("Pages, got more than: %d", len(tt.want))
+				}
+			}
+
+			AssertResponseBody(t, got, tt.want)
+		})
+	}
+}
+
+func TestGetChirpsDefaultLimit(t *testing.T) {
+	store := newFakeStore()
+	for range defaultChirpsLimit + 1 {
+		store.CreateChirp("chirp", 1)
+	}
+	api := apiConfig{DB: store}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/chirps", nil)
+	response := httptest.NewRecorder()
+	api.getChirps(response, request)
+
+	var chirps []database.Chirp
+	err := json.NewDecoder(response.Body).Decode(&chirps)
+	if err != nil {
+		t.Fatalf("error decoding JSON response: %v", err)
+	}
+
+	AssertResponseCode(t, response.Code, http.StatusOK)
+	if len(chirps) != defaultChirpsLimit || response.Header().Get("Link") == "" {
+		t.Errorf("Page without a limit, got: %d chirps and Link %q, want: %d and a next page", len(chirps), response.Header().Get("Link"), defaultChirpsLimit)
+	}
+}
+
+func TestGetChirpsInvalidQuery(t *testing.T) {
+	api := apiConfig{DB: newFakeStore()}
+
+	queries := []string{
+		"?since=yesterday",
+		"?until=2024-05-01",
+		"?limit=0",
+		"?limit=101",
+		"?cursor=not-a-cursor",
+		// {} and {"after_id":-1}
+		"?cursor=e30",
+		"?cursor=eyJhZnRlcl9pZCI6LTF9",
+		// {"after_id":1} from an id-ordered page
+		"?sort=created_at&cursor=eyJhZnRlcl9pZCI6MX0",
+	}
+
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/chirps"+query, nil)
+			response := httptest.NewRecorder()
+			api.getChirps(response, request)
+
+			AssertResponseCode(t, response.Code, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestPostChirps(t *testing.T) {
+	store := newFakeStore()
+	api := apiConfig{DB: store, jwtKeys: testJWTKeys}
+	author, _ := store.CreateUser("author@example.com", "hash")
+
+	token, err := auth.CreateJWT(author.Id, 0, "", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		statusCode int
+	}{
+		{name: "creates a chirp", token: token, body: `{"body":"hello"}`, statusCode: http.StatusCreated},
+		{name: "rejects a missing token", token: "", body: `{"body":"hello"}`, statusCode: http.StatusUnauthorized},
+		{name: "rejects a long chirp", token: token, body: `{"body":"` + strings.Repeat("a", 141) + `"}`, statusCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/chirps", strings.NewReader(tt.body))
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			response := httptest.NewRecorder()
+			api.postChirps(response, request)
+
+			AssertResponseCode(t, response.Code, tt.statusCode)
+		})
+	}
+}
+
+func TestPostChirpRestore(t *testing.T) {
+	store := newFakeStore()
+	api := apiConfig{DB: store, jwtKeys: testJWTKeys, chirpRestoreWindow: time.Hour}
+	store.CreateUser("owner@example.com", "hash")
+	store.CreateUser("other@example.com", "hash")
+
+	restorable, _ := store.CreateChirp("restorable", 1)
+	store.DeleteChirpById(restorable.Id)
+
+	expired, _ := store.CreateChirp("expired", 1)
+	deletedAt := time.Now().UTC().Add(-2 * time.Hour)
+	expired.DeletedAt = &deletedAt
+	store.setChirp(expired)
+
+	live, _ := store.CreateChirp("live", 1)
+
+	owner, err := auth.CreateJWT(1, 0, "", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	other, err := auth.CreateJWT(2, 0, "", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		chirpId    int
+		statusCode int
+	}{
+		{name: "rejects a missing token", token: "", chirpId: restorable.Id, statusCode: http.StatusUnauthorized},
+		{name: "rejects another author", token: other, chirpId: restorable.Id, statusCode: http.StatusForbidden},
+		{name: "rejects a chirp past the window", token: owner, chirpId: expired.Id, statusCode: http.StatusGone},
+		{name: "rejects a chirp that isn't deleted", token: owner, chirpId: live.Id, statusCode: http.StatusNotFound},
+		{name: "restores a chirp", token: owner, chirpId: restorable.Id, statusCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/chirps/{id}/restore", nil)
+			request.SetPathValue("id", strconv.Itoa(tt.chirpId))
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			response := httptest.NewRecorder()
+			api.postChirpRestore(response, request)
+
+			AssertResponseCode(t, response.Code, tt.statusCode)
+		})
+	}
+
+	_, err = store.GetChirpById(restorable.Id)
+	if err != nil {
+		t.Errorf("GetChirpById after restore, got: %v", err)
+	}
+}
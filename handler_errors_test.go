@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const (
+	testPolkaApiKey       = "test-polka-key"
+	testRefreshToken      = "test-refresh-token"
+	testDeletedChirpId    = 2
+	testFaultUserEmail    = "user@example.com"
+	testFaultUserPassword = "password"
+)
+
+func newFaultTestStore(t *testing.T, passwordHash string) *database.DB {
+	t.Helper()
+
+	store := newTestStore(t)
+	user, _ := store.CreateUser(testFaultUserEmail, passwordHash)
+	store.CreateChirp("live", user.Id)
+	store.CreateChirp("deleted", user.Id)
+	store.DeleteChirpById(testDeletedChirpId)
+	store.CreateRefreshToken(user.Id, testRefreshToken, time.Now().UTC().Add(time.Hour), database.Client{})
+	return store
+}
+
+func TestHandlerStorageErrors(t *testing.T) {
+	passwordHash, err := auth.HashPassword(testFaultUserPassword)
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+
+	token, err := auth.CreateJWT(1, 0, "", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	// The session lookup fails before it is run, so any session will do.
+	sessionToken, err := auth.CreateJWT(1, 0, "session", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	claims, err := auth.ParseJWT(token, testJWTKeys, nil)
+	if err != nil {
+		t.Fatalf("error parsing JWT: %v", err)
+	}
+
+	bearer := "Bearer " + token
+	login := `{"email":"` + testFaultUserEmail + `","password":"` + testFaultUserPassword + `"}`
+
+	tests := []struct {
+		name          string
+		op            string
+		kind          faultKind
+		method        string
+		target        string
+		authorization string
+		body          string
+		statusCode    int
+		// landed reports whether a partial write still reached the store.
+		landed func(store database.Store) bool
+	}{
+		{name: "list chirps fails", op: "ListChirps", kind: faultFail, method: http.MethodGet, target: "/api/chirps", statusCode: http.StatusInternalServerError},
+		{name: "list chirps reads a corrupt database", op: "ListChirps", kind: faultCorruptRead, method: http.MethodGet, target: "/api/chirps", statusCode: http.StatusInternalServerError},
+		{name: "list a page of chirps fails", op: "ListChirps", kind: faultFail, method: http.MethodGet, target: "/api/chirps?limit=1", statusCode: http.StatusInternalServerError},
+		{name: "get chirp fails", op: "GetChirpById", kind: faultFail, method: http.MethodGet, target: "/api/chirps/1", statusCode: http.StatusInternalServerError},
+		{name: "get chirp reads a corrupt database", op: "GetChirpById", kind: faultCorruptRead, method: http.MethodGet, target: "/api/chirps/1", statusCode: http.StatusInternalServerError},
+		{name: "create chirp fails", op: "CreateChirp", kind: faultFail, method: http.MethodPost, target: "/api/chirps", authorization: bearer, body: `{"body":"hello"}`, statusCode: http.StatusInternalServerError},
+		{
+			name: "create chirp partially writes", op: "CreateChirp", kind: faultPartialWrite, method: http.MethodPost, target: "/api/chirps", authorization: bearer, body: `{"body":"hello"}`, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				chirps, _ := store.GetChirps()
+				return len(chirps) == 2
+			},
+		},
+		{name: "delete chirp lookup fails", op: "GetChirpById", kind: faultFail, method: http.MethodDelete, target: "/api/chirps/1", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "delete chirp fails", op: "DeleteChirpById", kind: faultFail, method: http.MethodDelete, target: "/api/chirps/1", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{
+			name: "delete chirp partially writes", op: "DeleteChirpById", kind: faultPartialWrite, method: http.MethodDelete, target: "/api/chirps/1", authorization: bearer, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				_, err := store.GetDeletedChirpById(1)
+				return err == nil
+			},
+		},
+		{name: "restore chirp lookup fails", op: "GetDeletedChirpById", kind: faultCorruptRead, method: http.MethodPost, target: "/api/chirps/2/restore", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "restore chirp fails", op: "RestoreChirpById", kind: faultFail, method: http.MethodPost, target: "/api/chirps/2/restore", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "create user fails", op: "CreateUser", kind: faultFail, method: http.MethodPost, target: "/api/users", body: `{"email":"new@example.com","password":"pw"}`, statusCode: http.StatusInternalServerError},
+		{
+			name: "create user partially writes", op: "CreateUser", kind: faultPartialWrite, method: http.MethodPost, target: "/api/users", body: `{"email":"new@example.com","password":"pw"}`, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				users, _ := store.GetUsers()
+				return len(users) == 2
+			},
+		},
+		{name: "update user fails", op: "UpdateUserEmailPasswordById", kind: faultFail, method: http.MethodPut, target: "/api/users", authorization: bearer, body: `{"email":"new@example.com","password":"pw"}`, statusCode: http.StatusInternalServerError},
+		{name: "login lookup reads a corrupt database", op: "GetUserByEmail", kind: faultCorruptRead, method: http.MethodPost, target: "/api/login", body: login, statusCode: http.StatusInternalServerError},
+		{name: "login fails to store the refresh token", op: "CreateRefreshToken", kind: faultFail, method: http.MethodPost, target: "/api/login", body: login, statusCode: http.StatusInternalServerError},
+		{name: "refresh rotation fails", op: "RotateRefreshToken", kind: faultFail, method: http.MethodPost, target: "/api/refresh", authorization: "Bearer " + testRefreshToken, statusCode: http.StatusInternalServerError},
+		{
+			name: "refresh rotation partially writes", op: "RotateRefreshToken", kind: faultPartialWrite, method: http.MethodPost, target: "/api/refresh", authorization: "Bearer " + testRefreshToken, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				_, refreshToken, _ := store.GetUserAndRefreshTokenByRefreshToken(testRefreshToken)
+				return refreshToken.RotatedAt != nil
+			},
+		},
+		{name: "revoke fails", op: "DeleteRefreshToken", kind: faultFail, method: http.MethodPost, target: "/api/revoke", authorization: "Bearer " + testRefreshToken, statusCode: http.StatusInternalServerError},
+		{name: "list sessions fails", op: "GetRefreshTokensByUser", kind: faultFail, method: http.MethodGet, target: "/api/sessions", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "revoke session fails", op: "RevokeRefreshTokenFamily", kind: faultFail, method: http.MethodDelete, target: "/api/sessions/" + testRefreshToken, authorization: bearer, statusCode: http.StatusInternalServerError},
+		{
+			name: "revoke all sessions partially writes", op: "RevokeSessionsByUser", kind: faultPartialWrite, method: http.MethodPost, target: "/api/sessions/revoke-all", authorization: bearer, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				refreshTokens, _ := store.GetRefreshTokensByUser(1)
+				return len(refreshTokens) == 0
+			},
+		},
+		{name: "access token denylist lookup fails", op: "IsAccessTokenRevoked", kind: faultFail, method: http.MethodGet, target: "/api/sessions", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "access token session lookup fails", op: "IsRefreshTokenFamilyActive", kind: faultFail, method: http.MethodGet, target: "/api/sessions", authorization: "Bearer " + sessionToken, statusCode: http.StatusInternalServerError},
+		{name: "token version lookup reads a corrupt database", op: "GetUserById", kind: faultCorruptRead, method: http.MethodPut, target: "/api/users", authorization: bearer, body: `{"email":"new@example.com","password":"pw"}`, statusCode: http.StatusInternalServerError},
+		{name: "logout lookup fails", op: "IsAccessTokenRevoked", kind: faultFail, method: http.MethodPost, target: "/api/logout", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "logout fails", op: "RevokeAccessToken", kind: faultFail, method: http.MethodPost, target: "/api/logout", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{
+			name: "logout partially writes", op: "RevokeAccessToken", kind: faultPartialWrite, method: http.MethodPost, target: "/api/logout", authorization: bearer, statusCode: http.StatusInternalServerError,
+			landed: func(store database.Store) bool {
+				revoked, _ := store.IsAccessTokenRevoked(claims.ID)
+				return revoked
+			},
+		},
+		{name: "revoke all sessions fails", op: "RevokeSessionsByUser", kind: faultFail, method: http.MethodPost, target: "/api/sessions/revoke-all", authorization: bearer, statusCode: http.StatusInternalServerError},
+		{name: "upgrade fails", op: "UpgradeUserToRedByUserId", kind: faultFail, method: http.MethodPost, target: "/api/polka/webhooks", authorization: "ApiKey " + testPolkaApiKey, body: `{"event":"user.upgraded","data":{"user_id":1}}`, statusCode: http.StatusInternalServerError},
+		{name: "backup fails", op: "Backup", kind: faultCorruptRead, method: http.MethodPost, target: "/admin/backup", authorization: "ApiKey " + testAdminApiKey, statusCode: http.StatusInternalServerError},
+		{name: "backup download fails", op: "Backup", kind: faultFail, method: http.MethodGet, target: "/admin/backup", authorization: "ApiKey " + testAdminApiKey, statusCode: http.StatusInternalServerError},
+		{name: "replication snapshot fails", op: "Backup", kind: faultFail, method: http.MethodGet, target: "/admin/replication", authorization: "ApiKey " + testAdminApiKey, statusCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFaultTestStore(t, passwordHash)
+			faulty := newFaultyStore(store)
+			faulty.inject(tt.op, fault{kind: tt.kind})
+
+			handler := NewServer(apiConfig{
+				DB:                 faulty,
+				admin:              faulty,
+				replication:        faulty,
+				jwtKeys:            testJWTKeys,
+				polkaApiKey:        testPolkaApiKey,
+				adminApiKey:        testAdminApiKey,
+				backupDir:          t.TempDir(),
+				chirpRestoreWindow: time.Hour,
+			}, "").Handler
+
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			AssertResponseCode(t, response.Code, tt.statusCode)
+
+			if tt.landed != nil && !tt.landed(store) {
+				t.Errorf("partial write of %s didn't reach the store", tt.op)
+			}
+		})
+	}
+}
+
+func TestHandlerStorageLatency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	faulty := newFaultyStore(newTestStore(t))
+	faulty.inject("ListChirps", fault{kind: faultLatency, delay: delay})
+	api := apiConfig{DB: faulty}
+
+	start := time.Now()
+	request := httptest.NewRequest(http.MethodGet, "/api/chirps", nil)
+	response := httptest.NewRecorder()
+	api.getChirps(response, request)
+
+	AssertResponseCode(t, response.Code, http.StatusOK)
+
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Response time, got: %v, want at least: %v", elapsed, delay)
+	}
+}
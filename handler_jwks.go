@@ -0,0 +1,14 @@
+package main
+
+import (
+	"net/http"
+)
+
+// getJWKS publishes the public keys access tokens can be verified with, so
+// other services don't need the signing key.
+func (api *apiConfig) getJWKS(w http.ResponseWriter, r *http.Request) {
+	// Verifiers may cache the set briefly. A new signing key should be listed
+	// for verification before it starts signing.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, api.jwtKeys.JWKS())
+}
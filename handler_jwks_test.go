@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetJWKS(t *testing.T) {
+	handler := NewServer(apiConfig{jwtKeys: testJWTKeys}, "").Handler
+
+	request := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	// The test keyring only holds an HMAC secret, which is never published.
+	AssertResponseCode(t, response.Code, http.StatusOK)
+	AssertResponseBody(t, response.Body.String(), "{\"keys\":[]}")
+	AssertResponseHeader(t, response.Header().Get("Cache-Control"), "public, max-age=300")
+}
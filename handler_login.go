@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/iamhectorsosa/web-server/internal/auth"
+	database "github.com/iamhectorsosa/web-server/internal/database"
 )
 
 func (api *apiConfig) postLogin(w http.ResponseWriter, r *http.Request) {
@@ -21,20 +23,19 @@ func (api *apiConfig) postLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := api.DB.GetUserByEmail(payload.Email)
-	if err != nil {
+	if err == database.ErrUserDoesNotExist {
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email and/or password combination")
 		return
 	}
 
-	err = auth.CheckHashPassword(payload.Password, user.PasswordHash)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email and/or password combination")
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	token, err := auth.CreateJWT(user.Id, api.jwtSecret, payload.ExpiresInSeconds)
+	err = auth.CheckHashPassword(payload.Password, user.PasswordHash)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "JWT Token Creation failed")
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email and/or password combination")
 		return
 	}
 
@@ -44,22 +45,34 @@ func (api *apiConfig) postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = api.DB.CreateRefreshToken(user.Id, refreshToken, refreshTokenExpiration)
+	session, err := api.DB.CreateRefreshToken(user.Id, refreshToken, refreshTokenExpiration, requestClient(r))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Updating user failed")
 		return
 	}
 
+	// The access token belongs to the session, so revoking the session
+	// revokes it too.
+	token, err := auth.CreateJWT(user.Id, user.TokenVersion, session.FamilyId, api.jwtKeys, payload.ExpiresInSeconds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "JWT Token Creation failed")
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		Id           int       `json:"id"`
+		Email        string    `json:"email"`
+		IsChirpyRed  bool      `json:"is_chirpy_red"`
+		CreatedAt    time.Time `json:"created_at"`
+		UpdatedAt    time.Time `json:"updated_at"`
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token"`
 	}{
 		Id:           user.Id,
 		Email:        user.Email,
 		IsChirpyRed:  user.IsChirpyRed,
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
 		Token:        token,
 		RefreshToken: refreshToken,
 	})
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	database "github.com/iamhectorsosa/web-server/internal/database"
+	"github.com/iamhectorsosa/web-server/internal/search"
+)
+
+const defaultSearchLimit = 20
+
+// searchCursor marks where the next page of GET /api/chirps/search starts.
+// Results are ranked rather than ordered by id, so it counts results.
+type searchCursor struct {
+	Offset int `json:"offset"`
+}
+
+func (api *apiConfig) getChirpsSearch(w http.ResponseWriter, r *http.Request) {
+	query := search.ParseQuery(r.URL.Query().Get("q"))
+	if query.IsEmpty() {
+		respondWithError(w, http.StatusBadRequest, "Missing search query")
+		return
+	}
+
+	authorIdStr := r.URL.Query().Get("author_id")
+
+	if authorIdStr == "" {
+		authorIdStr = "0"
+	}
+
+	authorId, err := strconv.Atoi(authorIdStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Author ID")
+		return
+	}
+
+	limit, err := parseLimitQuery(r, defaultSearchLimit)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+
+	cursor := searchCursor{}
+	err = parseCursorQuery(r, &cursor)
+	if err != nil || cursor.Offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	results, total := api.search.index.Search(query, search.Options{
+		AuthorId: authorId,
+		Offset:   cursor.Offset,
+		Limit:    limit,
+	})
+
+	chirps := []database.Chirp{}
+	for _, result := range results {
+		chirp, err := api.DB.GetChirpById(result.Id)
+
+		// The index trails the store slightly, so a chirp deleted a moment
+		// ago can still match.
+		if err == database.ErrChirpDoesNotExist {
+			continue
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve Chirps")
+			return
+		}
+
+		chirps = append(chirps, chirp)
+	}
+
+	if next := cursor.Offset + len(results); next < total {
+		w.Header().Set("Link", nextPageLink(r, searchCursor{Offset: next}))
+	}
+
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	database "github.com/iamhectorsosa/web-server/internal/database"
+)
+
+// A session is one login, identified by its refresh token family, which
+// rotation keeps the same.
+type session struct {
+	Id         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// requestClient describes the client making r for its refresh token.
+func requestClient(r *http.Request) database.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return database.Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
+func (api *apiConfig) getSessions(w http.ResponseWriter, r *http.Request) {
+	authToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	refreshTokens, err := api.DB.GetRefreshTokensByUser(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve sessions")
+		return
+	}
+
+	// Each family has one token that hasn't been rotated, and it describes
+	// the session as last seen.
+	now := time.Now().UTC()
+	sessions := []session{}
+	for _, refreshToken := range refreshTokens {
+		if !refreshToken.IsSession(now) {
+			continue
+		}
+
+		sessions = append(sessions, session{
+			Id:         refreshToken.FamilyId,
+			CreatedAt:  refreshToken.CreatedAt,
+			LastUsedAt: refreshToken.LastUsedAt,
+			ExpiresAt:  refreshToken.ExpiresAt,
+			UserAgent:  refreshToken.UserAgent,
+			IP:         refreshToken.IP,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (api *apiConfig) deleteSession(w http.ResponseWriter, r *http.Request) {
+	authToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	// Another user's session looks the same as a missing one, so ids can't
+	// be probed.
+	err = api.DB.RevokeRefreshTokenFamily(userId, r.PathValue("id"))
+
+	if err == database.ErrRefreshTokenDoesNotExist {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *apiConfig) postSessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	authToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	// Access tokens are signed out as well, including the one making this
+	// request.
+	revoked, err := api.DB.RevokeSessionsByUser(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Revoked int `json:"revoked"`
+	}{
+		Revoked: revoked,
+	})
+}
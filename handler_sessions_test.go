@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+func TestSessions(t *testing.T) {
+	store := newFakeStore()
+	user, _ := store.CreateUser("user@example.com", "hash")
+	other, _ := store.CreateUser("other@example.com", "hash")
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	laptop, _ := store.CreateRefreshToken(user.Id, "laptop", expiresAt, database.Client{UserAgent: "Firefox", IP: "192.0.2.1"})
+	store.CreateRefreshToken(user.Id, "expired", time.Now().UTC().Add(-time.Hour), database.Client{})
+	otherPhone, _ := store.CreateRefreshToken(other.Id, "other-phone", expiresAt, database.Client{})
+
+	handler := NewServer(apiConfig{DB: store, jwtKeys: testJWTKeys}, "").Handler
+	token, err := auth.CreateJWT(user.Id, 0, "", testJWTKeys, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	serve := func(method, target, authorization string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", authorization)
+		request.Header.Set("User-Agent", "Safari")
+		request.RemoteAddr = "198.51.100.7:52000"
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	listSessions := func() []session {
+		response := serve(http.MethodGet, "/api/sessions", "Bearer "+token)
+		AssertResponseCode(t, response.Code, http.StatusOK)
+
+		var sessions []session
+		err := json.NewDecoder(response.Body).Decode(&sessions)
+		if err != nil {
+			t.Fatalf("error decoding JSON response: %v", err)
+		}
+		return sessions
+	}
+
+	AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", "").Code, http.StatusUnauthorized)
+
+	// Rotating the laptop's token keeps its session and records the client
+	// that refreshed it.
+	AssertResponseCode(t, serve(http.MethodPost, "/api/refresh", "Bearer laptop").Code, http.StatusOK)
+
+	sessions := listSessions()
+	if len(sessions) != 1 {
+		t.Fatalf("sessions, got: %+v, want only the laptop", sessions)
+	}
+	got := sessions[0]
+	if got.Id != laptop.FamilyId || got.UserAgent != "Safari" || got.IP != "198.51.100.7" || got.LastUsedAt.Before(got.CreatedAt) {
+		t.Errorf("session, got: %+v", got)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		statusCode int
+	}{
+		{name: "can't revoke another user's session", method: http.MethodDelete, target: "/api/sessions/" + otherPhone.FamilyId, statusCode: http.StatusNotFound},
+		{name: "revokes a session", method: http.MethodDelete, target: "/api/sessions/" + laptop.FamilyId, statusCode: http.StatusNoContent},
+		{name: "revoking it again finds nothing", method: http.MethodDelete, target: "/api/sessions/" + laptop.FamilyId, statusCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertResponseCode(t, serve(tt.method, tt.target, "Bearer "+token).Code, tt.statusCode)
+		})
+	}
+
+	AssertResponseBody(t, listSessions(), []session{})
+	if _, _, err := store.GetUserAndRefreshTokenByRefreshToken("other-phone"); err != nil {
+		t.Errorf("other user's session, got: %v, want it left alone", err)
+	}
+
+	// Revoking every session counts them as listed, not the rotated and
+	// expired tokens left behind.
+	store.CreateRefreshToken(user.Id, "phone", expiresAt, database.Client{})
+	AssertResponseCode(t, serve(http.MethodPost, "/api/refresh", "Bearer phone").Code, http.StatusOK)
+	if sessions := listSessions(); len(sessions) != 1 {
+		t.Fatalf("sessions, got: %+v, want only the phone", sessions)
+	}
+
+	response := serve(http.MethodPost, "/api/sessions/revoke-all", "Bearer "+token)
+	AssertResponseCode(t, response.Code, http.StatusOK)
+	AssertResponseBody(t, response.Body.String(), "{\"revoked\":1}")
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/iamhectorsosa/web-server/internal/auth"
+	database "github.com/iamhectorsosa/web-server/internal/database"
 )
 
 func (api *apiConfig) postRefresh(w http.ResponseWriter, r *http.Request) {
@@ -15,32 +15,80 @@ func (api *apiConfig) postRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, refreshToken, err := api.DB.GetUserAndRefreshTokenByRefreshToken(authRefreshToken)
-
+	newRefreshToken, refreshTokenExpiration, err := auth.CreateRefreshToken()
 	if err != nil {
-		log.Printf("Error with refresh token: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Refresh Token Creation failed")
+		return
+	}
+
+	user, refreshToken, err := api.DB.RotateRefreshToken(authRefreshToken, newRefreshToken, refreshTokenExpiration, requestClient(r))
+
+	if err == database.ErrRefreshTokenReused {
+		log.Printf("Security: rotated refresh token reused for user %d, revoked token family %s", refreshToken.UserId, refreshToken.FamilyId)
 		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
 		return
 	}
 
-	if refreshToken.ExpiresAt.Before(time.Now().UTC()) {
+	if err == database.ErrRefreshTokenDoesNotExist || err == database.ErrUserDoesNotExist {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	if err == database.ErrRefreshTokenExpired {
 		respondWithError(w, http.StatusUnauthorized, "Refresh token expired")
 		return
 	}
 
-	token, err := auth.CreateJWT(user.Id, api.jwtSecret, 0)
+	if err != nil {
+		log.Printf("Error with refresh token: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	token, err := auth.CreateJWT(user.Id, user.TokenVersion, refreshToken.FamilyId, api.jwtKeys, 0)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "JWT Token Creation failed")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}{
-		Token: token,
+		Token:        token,
+		RefreshToken: newRefreshToken,
 	})
 }
 
+// postLogout revokes the access token making the request, which otherwise
+// stays valid until it expires.
+func (api *apiConfig) postLogout(w http.ResponseWriter, r *http.Request) {
+	authToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		return
+	}
+
+	claims, err := auth.ParseJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		respondWithError(w, http.StatusBadRequest, "Access token can't be revoked")
+		return
+	}
+
+	err = api.DB.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke access token")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (api *apiConfig) postRevoke(w http.ResponseWriter, r *http.Request) {
 
 	authRefreshToken, err := auth.GetBearerToken(r.Header)
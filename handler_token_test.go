@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+func TestPostRefreshRotatesToken(t *testing.T) {
+	store := newFakeStore()
+	user, _ := store.CreateUser("user@example.com", "hash")
+	store.CreateRefreshToken(user.Id, testRefreshToken, time.Now().UTC().Add(time.Hour), database.Client{})
+	store.CreateRefreshToken(user.Id, "expired-token", time.Now().UTC().Add(-time.Hour), database.Client{})
+	api := apiConfig{DB: store, jwtKeys: testJWTKeys}
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		api.postRefresh(response, request)
+		return response
+	}
+
+	response := refresh(testRefreshToken)
+	AssertResponseCode(t, response.Code, http.StatusOK)
+
+	body := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	err := json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		t.Fatalf("error decoding JSON response: %v", err)
+	}
+
+	userId, err := auth.ValidateJWT(body.Token, testJWTKeys, tokenRevocations{store})
+	if err != nil || userId != user.Id {
+		t.Errorf("access token, got user: %d, %v, want: %d", userId, err, user.Id)
+	}
+	if body.RefreshToken == "" || body.RefreshToken == testRefreshToken {
+		t.Fatalf("refresh token, got: %q, want a new one", body.RefreshToken)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{name: "rejects an expired token", token: "expired-token", statusCode: http.StatusUnauthorized},
+		{name: "rejects reuse of the rotated token", token: testRefreshToken, statusCode: http.StatusUnauthorized},
+		{name: "rejects the new token once its family is revoked", token: body.RefreshToken, statusCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertResponseCode(t, refresh(tt.token).Code, tt.statusCode)
+		})
+	}
+}
+
+func TestAccessTokenRevocation(t *testing.T) {
+	store := newFakeStore()
+	user, _ := store.CreateUser("user@example.com", "hash")
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	laptopSession, _ := store.CreateRefreshToken(user.Id, "laptop", expiresAt, database.Client{})
+	phoneSession, _ := store.CreateRefreshToken(user.Id, "phone", expiresAt, database.Client{})
+	handler := NewServer(apiConfig{DB: store, jwtKeys: testJWTKeys}, "").Handler
+
+	serve := func(method, target, token, body string) int {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	createJWT := func(sessionId string) string {
+		current, _ := store.GetUserById(user.Id)
+		token, err := auth.CreateJWT(user.Id, current.TokenVersion, sessionId, testJWTKeys, 0)
+		if err != nil {
+			t.Fatalf("error creating JWT: %v", err)
+		}
+		return token
+	}
+
+	loggedOut, other := createJWT(""), createJWT("")
+	AssertResponseCode(t, serve(http.MethodPost, "/api/logout", loggedOut, ""), http.StatusNoContent)
+
+	// Logging out revokes only the token that made the request.
+	AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", loggedOut, ""), http.StatusUnauthorized)
+	AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", other, ""), http.StatusOK)
+
+	// Revoking a session revokes its access tokens along with it.
+	laptop, phone := createJWT(laptopSession.FamilyId), createJWT(phoneSession.FamilyId)
+	AssertResponseCode(t, serve(http.MethodDelete, "/api/sessions/"+laptopSession.FamilyId, phone, ""), http.StatusNoContent)
+	AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", laptop, ""), http.StatusUnauthorized)
+	AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", phone, ""), http.StatusOK)
+
+	// A new password revokes refresh tokens too, or one could mint access
+	// tokens under the new token version.
+	passwordChanged := createJWT("")
+	AssertResponseCode(t, serve(http.MethodPut, "/api/users", passwordChanged, `{"email":"user@example.com","password":"new-password"}`), http.StatusOK)
+	AssertResponseCode(t, serve(http.MethodPost, "/api/refresh", "phone", ""), http.StatusUnauthorized)
+
+	revokedAll := createJWT("")
+	AssertResponseCode(t, serve(http.MethodPost, "/api/sessions/revoke-all", revokedAll, ""), http.StatusOK)
+
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{name: "rejects a token from before a password change", token: passwordChanged, statusCode: http.StatusUnauthorized},
+		{name: "rejects a token from before revoking all sessions", token: revokedAll, statusCode: http.StatusUnauthorized},
+		{name: "rejects an older token", token: other, statusCode: http.StatusUnauthorized},
+		{name: "accepts a new token", token: createJWT(""), statusCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertResponseCode(t, serve(http.MethodGet, "/api/sessions", tt.token, ""), tt.statusCode)
+		})
+	}
+}
+
+func TestPutUsersRevokesTokensOnlyForANewPassword(t *testing.T) {
+	passwordHash, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+
+	store := newFakeStore()
+	user, _ := store.CreateUser("user@example.com", passwordHash)
+	store.CreateRefreshToken(user.Id, testRefreshToken, time.Now().UTC().Add(time.Hour), database.Client{})
+	handler := NewServer(apiConfig{DB: store, jwtKeys: testJWTKeys}, "").Handler
+
+	putUser := func(body string) {
+		t.Helper()
+		current, _ := store.GetUserById(user.Id)
+		token, err := auth.CreateJWT(user.Id, current.TokenVersion, "", testJWTKeys, 0)
+		if err != nil {
+			t.Fatalf("error creating JWT: %v", err)
+		}
+
+		request := httptest.NewRequest(http.MethodPut, "/api/users", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		AssertResponseCode(t, response.Code, http.StatusOK)
+	}
+
+	// A new email alone keeps the user signed in.
+	putUser(`{"email":"new@example.com","password":"password"}`)
+	updated, _ := store.GetUserById(user.Id)
+	if updated.TokenVersion != user.TokenVersion {
+		t.Errorf("token version after an email change, got: %d, want: %d", updated.TokenVersion, user.TokenVersion)
+	}
+	if refreshTokens, _ := store.GetRefreshTokensByUser(user.Id); len(refreshTokens) != 1 {
+		t.Errorf("refresh tokens after an email change, got: %d, want: 1", len(refreshTokens))
+	}
+
+	putUser(`{"email":"new@example.com","password":"new-password"}`)
+	updated, _ = store.GetUserById(user.Id)
+	if updated.TokenVersion != user.TokenVersion+1 {
+		t.Errorf("token version after a password change, got: %d, want: %d", updated.TokenVersion, user.TokenVersion+1)
+	}
+	if refreshTokens, _ := store.GetRefreshTokensByUser(user.Id); len(refreshTokens) != 0 {
+		t.Errorf("refresh tokens after a password change, got: %d, want: 0", len(refreshTokens))
+	}
+	if auth.CheckHashPassword("new-password", updated.PasswordHash) != nil {
+		t.Error("password hash after a password change does not match the new password")
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/iamhectorsosa/web-server/internal/auth"
+	database "github.com/iamhectorsosa/web-server/internal/database"
 )
 
 func (api *apiConfig) postUsers(w http.ResponseWriter, r *http.Request) {
@@ -26,19 +28,28 @@ func (api *apiConfig) postUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := api.DB.CreateUser(payload.Email, passwordHash)
-	if err != nil {
+	if err == database.ErrUserAlreadyExists {
 		respondWithError(w, http.StatusBadRequest, "User creation failed")
 		return
 	}
 
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
 	respondWithJSON(w, http.StatusCreated, struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id          int       `json:"id"`
+		Email       string    `json:"email"`
+		IsChirpyRed bool      `json:"is_chirpy_red"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}{
 		Id:          user.Id,
 		Email:       user.Email,
 		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
 	})
 }
 
@@ -50,9 +61,9 @@ func (api *apiConfig) putUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId, err := auth.ValidateJWT(authToken, api.jwtSecret)
+	userId, err := auth.ValidateJWT(authToken, api.jwtKeys, tokenRevocations{api.DB})
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
+		respondWithJWTError(w, err)
 		return
 	}
 
@@ -67,25 +78,55 @@ func (api *apiConfig) putUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordHash, err := auth.HashPassword(payload.Password)
+	user, err := api.DB.GetUserById(userId)
+	if err == database.ErrUserDoesNotExist {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Password hashing failed")
+		respondWithError(w, http.StatusInternalServerError, "Error updating User")
+		return
+	}
+
+	// bcrypt salts every hash, so an unchanged password keeps its hash; the
+	// store revokes the user's tokens whenever the hash changes.
+	passwordHash := user.PasswordHash
+	if auth.CheckHashPassword(payload.Password, user.PasswordHash) != nil {
+		passwordHash, err = auth.HashPassword(payload.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Password hashing failed")
+			return
+		}
+	}
+
+	user, err = api.DB.UpdateUserEmailPasswordById(userId, payload.Email, passwordHash)
+	if err == database.ErrUserAlreadyExists {
+		respondWithError(w, http.StatusBadRequest, "Email already in use")
+		return
+	}
+
+	if err == database.ErrUserDoesNotExist {
+		respondWithError(w, http.StatusNotFound, "User not found")
 		return
 	}
 
-	user, err := api.DB.UpdateUserEmailPasswordById(userId, payload.Email, passwordHash)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error updating User")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id          int       `json:"id"`
+		Email       string    `json:"email"`
+		IsChirpyRed bool      `json:"is_chirpy_red"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}{
 		Id:          user.Id,
 		Email:       user.Email,
 		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
 	})
 }
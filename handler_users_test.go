@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/iamhectorsosa/web-server/internal/auth"
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+// vanishingUserStore loses the user between validating their access token
+// and updating them.
+type vanishingUserStore struct {
+	*fakeStore
+}
+
+func (s vanishingUserStore) UpdateUserEmailPasswordById(userId int, email, passwordHash string) (database.User, error) {
+	return database.User{}, database.ErrUserDoesNotExist
+}
+
+func TestPutUsersErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      func(store *fakeStore) database.HandlerStore
+		body       string
+		statusCode int
+	}{
+		{
+			name:       "rejects another user's email",
+			store:      func(store *fakeStore) database.HandlerStore { return store },
+			body:       `{"email":"other@example.com","password":"password"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "reports a missing user",
+			store:      func(store *fakeStore) database.HandlerStore { return vanishingUserStore{store} },
+			body:       `{"email":"new@example.com","password":"password"}`,
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			user, _ := store.CreateUser("user@example.com", "hash")
+			store.CreateUser("other@example.com", "hash")
+			handler := NewServer(apiConfig{DB: tt.store(store), jwtKeys: testJWTKeys}, "").Handler
+
+			token, err := auth.CreateJWT(user.Id, user.TokenVersion, "", testJWTKeys, 0)
+			if err != nil {
+				t.Fatalf("error creating JWT: %v", err)
+			}
+
+			request := httptest.NewRequest(http.MethodPut, "/api/users", strings.NewReader(tt.body))
+			request.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			AssertResponseCode(t, response.Code, tt.statusCode)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,6 +15,8 @@ import (
 )
 
 var ErrJWTInvalidIssuer = errors.New("Invalid JWT issuer")
+var ErrJWTRevoked = errors.New("JWT has been revoked")
+var ErrRevocationLookup = errors.New("Couldn't check whether JWT was revoked")
 var ErrNoAuthHeaderIncluded = errors.New("Authentication header not included in request")
 var ErrAuthHeaderMalformed = errors.New("Malformed authorization header")
 
@@ -35,54 +38,131 @@ func CheckHashPassword(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-func CreateJWT(userId int, tokenSecret string, expiresInSeconds int) (string, error) {
+// Claims are an access token's claims. TokenVersion is the user's token
+// version when the token was issued, and SessionId the refresh token family
+// of the login it was issued to.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenVersion int    `json:"ver"`
+	SessionId    string `json:"sid,omitempty"`
+}
+
+// Revocations reports access tokens revoked before they expire: one by one
+// through their id, per session once the session is revoked, or all at once
+// by bumping the user's token version. Lookups about a user who no longer
+// exists return ErrJWTRevoked.
+type Revocations interface {
+	IsAccessTokenRevoked(id string) (bool, error)
+	IsSessionActive(userId int, sessionId string) (bool, error)
+	GetTokenVersion(userId int) (int, error)
+}
+
+// CreateJWT signs an access token for userId with the keyring's signing key.
+// sessionId ties the token to a session, and may be empty for tokens that
+// aren't issued to one.
+func CreateJWT(userId, tokenVersion int, sessionId string, keys *Keyring, expiresInSeconds int) (string, error) {
 	expiresAt := defaultJWTExpiresInHours * time.Hour
 
 	if expiresInSeconds > 0 {
 		expiresAt = time.Duration(expiresInSeconds)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    defaultJWTIssuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresAt)),
-		Subject:   strconv.Itoa(userId),
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(keys.signing.method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresAt)),
+			Subject:   strconv.Itoa(userId),
+		},
+		TokenVersion: tokenVersion,
+		SessionId:    sessionId,
 	})
-	return token.SignedString([]byte(tokenSecret))
+	token.Header["kid"] = keys.signing.Id
+	return token.SignedString(keys.signing.signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (int, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
-	)
+// ValidateJWT checks tokenString like ParseJWT and returns the user it was
+// issued to.
+func ValidateJWT(tokenString string, keys *Keyring, revocations Revocations) (int, error) {
+	claims, err := ParseJWT(tokenString, keys, revocations)
 	if err != nil {
 		return 0, err
 	}
 
-	userIDString, err := token.Claims.GetSubject()
+	return strconv.Atoi(claims.Subject)
+}
+
+// ParseJWT checks tokenString against the keyring key named by its kid
+// header and, unless revocations is nil, that it hasn't been revoked. A
+// failure to look revocations up is reported as ErrRevocationLookup, so it
+// isn't mistaken for a bad token.
+func ParseJWT(tokenString string, keys *Keyring, revocations Revocations) (Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		keys.verificationKey,
+	)
 	if err != nil {
-		return 0, err
+		return Claims{}, err
+	}
+
+	if claims.Issuer != defaultJWTIssuer {
+		return Claims{}, ErrJWTInvalidIssuer
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	userId, err := strconv.Atoi(claims.Subject)
+
 	if err != nil {
-		return 0, err
+		return Claims{}, err
 	}
 
-	if issuer != defaultJWTIssuer {
-		return 0, ErrJWTInvalidIssuer
+	if revocations == nil {
+		return claims, nil
 	}
 
-	userId, err := strconv.Atoi(userIDString)
+	// Tokens issued before ids were added can only be revoked by version.
+	if claims.ID != "" {
+		revoked, err := revocations.IsAccessTokenRevoked(claims.ID)
+		if err != nil {
+			return Claims{}, fmt.Errorf("%w: %v", ErrRevocationLookup, err)
+		}
+		if revoked {
+			return Claims{}, ErrJWTRevoked
+		}
+	}
+
+	if claims.SessionId != "" {
+		active, err := revocations.IsSessionActive(userId, claims.SessionId)
+		if err != nil {
+			return Claims{}, fmt.Errorf("%w: %v", ErrRevocationLookup, err)
+		}
+		if !active {
+			return Claims{}, ErrJWTRevoked
+		}
+	}
+
+	tokenVersion, err := revocations.GetTokenVersion(userId)
+	if err == ErrJWTRevoked {
+		return Claims{}, err
+	}
 
 	if err != nil {
-		return 0, err
+		return Claims{}, fmt.Errorf("%w: %v", ErrRevocationLookup, err)
+	}
+
+	if claims.TokenVersion != tokenVersion {
+		return Claims{}, ErrJWTRevoked
 	}
 
-	return userId, nil
+	return claims, nil
 }
 
 func CreateRefreshToken() (string, time.Time, error) {
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrJWTUnknownKey = errors.New("JWT signed with an unknown key")
+
+// Key signs or verifies JWTs under an id, which tokens carry in their kid
+// header.
+type Key struct {
+	Id     string
+	method jwt.SigningMethod
+	// signingKey is nil for keys that only verify.
+	signingKey      any
+	verificationKey any
+}
+
+// NewHMACKey returns an HS256 key. Its secret signs and verifies, so it is
+// never published.
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{Id: id, method: jwt.SigningMethodHS256, signingKey: secret, verificationKey: secret}
+}
+
+// ParseKey reads a PEM encoded RSA or Ed25519 key. A private key can sign,
+// while a public key only verifies. An empty id is replaced by the key's
+// RFC 7638 thumbprint.
+func ParseKey(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	key := Key{Id: id}
+	switch parsed := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.signingKey, key.verificationKey = jwt.SigningMethodRS256, parsed, &parsed.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verificationKey = jwt.SigningMethodRS256, parsed
+	case ed25519.PrivateKey:
+		key.method, key.signingKey, key.verificationKey = jwt.SigningMethodEdDSA, parsed, parsed.Public()
+	case ed25519.PublicKey:
+		key.method, key.verificationKey = jwt.SigningMethodEdDSA, parsed
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if key.Id == "" {
+		key.Id, err = key.thumbprint()
+		if err != nil {
+			return Key{}, err
+		}
+	}
+	return key, nil
+}
+
+// Keyring signs new tokens with one key and accepts tokens signed by any of
+// its keys, so a retired signing key keeps verifying until the tokens it
+// signed have expired.
+type Keyring struct {
+	signing Key
+	keys    map[string]Key
+}
+
+func NewKeyring(signing Key, verifying ...Key) (*Keyring, error) {
+	if signing.signingKey == nil {
+		return nil, fmt.Errorf("key %q can't sign", signing.Id)
+	}
+
+	keyring := &Keyring{signing: signing, keys: map[string]Key{}}
+	for _, key := range append([]Key{signing}, verifying...) {
+		if _, ok := keyring.keys[key.Id]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.Id)
+		}
+		keyring.keys[key.Id] = key
+	}
+	return keyring, nil
+}
+
+// verificationKey returns the key a token was signed with. Tokens without a
+// kid predate key ids and were signed with the HMAC secret.
+func (keyring *Keyring) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	var key Key
+	var ok bool
+	if kid == "" {
+		key, ok = keyring.legacyKey()
+	} else {
+		key, ok = keyring.keys[kid]
+	}
+	if !ok {
+		return nil, ErrJWTUnknownKey
+	}
+
+	// A token has to use its key's algorithm, or an RSA public key could be
+	// passed off as an HMAC secret.
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("JWT algorithm %s doesn't match key %q", token.Method.Alg(), key.Id)
+	}
+	return key.verificationKey, nil
+}
+
+func (keyring *Keyring) legacyKey() (Key, bool) {
+	for _, key := range keyring.keys {
+		if key.method == jwt.SigningMethodHS256 {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// JWK is the public half of a key as published in a JSON Web Key Set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys other services can verify tokens with. HMAC
+// keys are left out, as their secret would be published with them.
+func (keyring *Keyring) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	// The signing key comes first, then the rest by id, so the set is stable.
+	ids := []string{keyring.signing.Id}
+	for id := range keyring.keys {
+		if id != keyring.signing.Id {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids[1:])
+
+	for _, id := range ids {
+		jwk, ok := keyring.keys[id].jwk()
+		if ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks
+}
+
+func (key Key) jwk() (JWK, bool) {
+	jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.method.Alg()}
+
+	switch public := key.verificationKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// thumbprint hashes the required members of the key's JWK in lexical order,
+// as RFC 7638 specifies.
+func (key Key) thumbprint() (string, error) {
+	jwk, ok := key.jwk()
+	if !ok {
+		return "", errors.New("key has no public JWK")
+	}
+
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{E: jwk.E, Kty: jwk.Kty, N: jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{Crv: jwk.Crv, Kty: jwk.Kty, X: jwk.X}
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(digest[:]), nil
+}
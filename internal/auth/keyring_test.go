@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func pemKey(t *testing.T, blockType string, key any) []byte {
+	t.Helper()
+
+	var der []byte
+	var err error
+	if blockType == "PUBLIC KEY" {
+		der, err = x509.MarshalPKIXPublicKey(key)
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestKeyring(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating RSA key: %v", err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating Ed25519 key: %v", err)
+	}
+
+	oldKey, err := ParseKey("", pemKey(t, "PRIVATE KEY", rsaKey))
+	if err != nil {
+		t.Fatalf("error parsing RSA key: %v", err)
+	}
+	newKey, err := ParseKey("", pemKey(t, "PRIVATE KEY", edKey))
+	if err != nil {
+		t.Fatalf("error parsing Ed25519 key: %v", err)
+	}
+	newPublic, err := ParseKey("", pemKey(t, "PUBLIC KEY", edPublic))
+	if err != nil || newPublic.Id != newKey.Id {
+		t.Fatalf("ParseKey of the public half, got: %q, %v, want id %q", newPublic.Id, err, newKey.Id)
+	}
+
+	_, err = NewKeyring(newPublic)
+	if err == nil {
+		t.Errorf("NewKeyring with a public signing key, got no error")
+	}
+
+	secret := NewHMACKey("secret", []byte("test-secret"))
+	before, _ := NewKeyring(oldKey, secret)
+	after, _ := NewKeyring(newKey, oldKey, secret)
+
+	signedBefore, err := CreateJWT(1, 0, "", before, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+	signedAfter, err := CreateJWT(2, 0, "", after, 0)
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	// Tokens from before key ids have no kid and were signed with the secret.
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    defaultJWTIssuer,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		Subject:   "3",
+	}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	// Signing with the RSA public key as an HMAC secret mustn't pass.
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    defaultJWTIssuer,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		Subject:   "4",
+	})
+	confused.Header["kid"] = oldKey.Id
+	forged, err := confused.SignedString(pemKey(t, "PUBLIC KEY", &rsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("error creating JWT: %v", err)
+	}
+
+	verifyOnly, _ := NewKeyring(NewHMACKey("other", []byte("other-secret")), newPublic)
+
+	tests := []struct {
+		name    string
+		token   string
+		keyring *Keyring
+		userId  int
+		wantErr bool
+	}{
+		{name: "verifies a token from the retired key", token: signedBefore, keyring: after, userId: 1},
+		{name: "verifies a token from the signing key", token: signedAfter, keyring: after, userId: 2},
+		{name: "verifies with only the public key", token: signedAfter, keyring: verifyOnly, userId: 2},
+		{name: "verifies a token without a kid", token: legacy, keyring: after, userId: 3},
+		{name: "rejects an unknown kid", token: signedAfter, keyring: before, wantErr: true},
+		{name: "rejects a mismatched algorithm", token: forged, keyring: after, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userId, err := ValidateJWT(tt.token, tt.keyring, nil)
+			if (err != nil) != tt.wantErr || userId != tt.userId {
+				t.Errorf("ValidateJWT, got: %d, %v, want: %d, error: %t", userId, err, tt.userId, tt.wantErr)
+			}
+		})
+	}
+
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("JWKS, got: %+v, want the two public keys", jwks)
+	}
+	if got := jwks.Keys[0]; got.Kid != newKey.Id || got.Kty != "OKP" || got.Alg != "EdDSA" || got.X == "" {
+		t.Errorf("JWKS signing key, got: %+v", got)
+	}
+	if got := jwks.Keys[1]; got.Kid != oldKey.Id || got.Kty != "RSA" || got.Alg != "RS256" || got.E != "AQAB" {
+		t.Errorf("JWKS retired key, got: %+v", got)
+	}
+}
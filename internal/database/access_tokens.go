@@ -0,0 +1,54 @@
+package database
+
+import "time"
+
+// RevokedAccessToken keeps an access token's id on the denylist until the
+// token would have expired anyway, after which it can be purged.
+type RevokedAccessToken struct {
+	Id        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (db *DB) RevokeAccessToken(id string, expiresAt time.Time) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		dbStructure.PutRevokedAccessToken(RevokedAccessToken{Id: id, ExpiresAt: expiresAt})
+		return nil
+	})
+}
+
+func (db *DB) IsAccessTokenRevoked(id string) (bool, error) {
+	var revoked bool
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		_, revoked = dbStructure.RevokedAccessTokens[id]
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// PurgeRevokedAccessTokens drops denylist entries for tokens that expired
+// before cutoff and returns how many there were.
+func (db *DB) PurgeRevokedAccessTokens(cutoff time.Time) (int, error) {
+	purged := 0
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		for id, revoked := range dbStructure.RevokedAccessTokens {
+			if revoked.ExpiresAt.Before(cutoff) {
+				dbStructure.DeleteRevokedAccessToken(id)
+				purged++
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
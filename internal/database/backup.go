@@ -0,0 +1,166 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidSnapshot = errors.New("Invalid database snapshot")
+
+// Backup writes a gzip-compressed JSON snapshot of the database. Writers are
+// blocked while it runs so the snapshot is consistent.
+func (db *DB) Backup(w io.Writer) error {
+	return db.View(func(dbStructure *DBStructure) error {
+		return writeSnapshot(w, dbStructure, db.aead)
+	})
+}
+
+// Restore replaces the whole database with a snapshot written by Backup,
+// after checking it against the current schema.
+func (db *DB) Restore(r io.Reader) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	snapshot, err := readSnapshot(r, db.aead, db.opts.AllowPlaintext)
+	if err != nil {
+		return err
+	}
+
+	defer db.flush()
+
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Ids issued since the backup was taken stay retired.
+	snapshot.syncSequences()
+	for kind, last := range db.data.Sequences {
+		snapshot.advanceSequence(kind, last)
+	}
+
+	// Empty the log durably before the snapshot is replaced: replaying it on
+	// the restored data would bring back what the restore undid. Compacting
+	// rather than truncating keeps the current data if the restore fails.
+	err = db.compact()
+	if err != nil {
+		return err
+	}
+
+	err = db.writeDB(snapshot)
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	snapshot.buildIndexes()
+	db.data = snapshot
+	db.queue(Event{Type: DatabaseRestored})
+	return nil
+}
+
+// Snapshots are gzip-compressed JSON, sealed after compression when the
+// database is encrypted.
+func writeSnapshot(w io.Writer, dbStructure *DBStructure, aead cipher.AEAD) error {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+
+	err := json.NewEncoder(gz).Encode(dbStructure)
+	if err != nil {
+		return fmt.Errorf("problem encoding snapshot, %v", err)
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("problem compressing snapshot, %v", err)
+	}
+
+	data, err := seal(aead, compressed.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return fmt.Errorf("problem writing snapshot, %v", err)
+	}
+
+	return nil
+}
+
+func readSnapshot(r io.Reader, aead cipher.AEAD, allowPlaintext bool) (DBStructure, error) {
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("problem reading snapshot, %v", err)
+	}
+
+	compressed, err := unseal(aead, sealed, allowPlaintext)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	defer gz.Close()
+
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	snapshot, _, err := migrateDocument(data)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	err = snapshot.validate()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	return snapshot, nil
+}
+
+func (dbStructure *DBStructure) validate() error {
+	emails := map[string]int{}
+	for id, user := range dbStructure.Users {
+		if user.Id != id {
+			return fmt.Errorf("user stored under id %d has id %d", id, user.Id)
+		}
+		if other, ok := emails[user.Email]; ok {
+			return fmt.Errorf("users %d and %d share email %q", other, id, user.Email)
+		}
+		emails[user.Email] = id
+	}
+
+	for id, chirp := range dbStructure.Chirps {
+		if chirp.Id != id {
+			return fmt.Errorf("chirp stored under id %d has id %d", id, chirp.Id)
+		}
+	}
+
+	for token, refreshToken := range dbStructure.RefreshTokens {
+		if refreshToken.TokenHash != token {
+			return fmt.Errorf("refresh token stored under %q has token hash %q", token, refreshToken.TokenHash)
+		}
+		if _, ok := dbStructure.Users[refreshToken.UserId]; !ok {
+			return fmt.Errorf("refresh token belongs to missing user %d", refreshToken.UserId)
+		}
+	}
+
+	for id, revoked := range dbStructure.RevokedAccessTokens {
+		if revoked.Id != id {
+			return fmt.Errorf("revoked access token stored under %q has id %q", id, revoked.Id)
+		}
+	}
+
+	return nil
+}
@@ -2,94 +2,283 @@ package database
 
 import (
 	"errors"
+	"slices"
+	"time"
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorId  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt marks a soft-deleted chirp. Such chirps are hidden from
+	// every read except GetDeletedChirpById until they are restored or
+	// purged.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 var ErrChirpDoesNotExist = errors.New("Chirp doesn't exist")
 
 func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+	var newChirp Chirp
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		newChirp = Chirp{
+			Id:        dbStructure.nextId(db.opts.IDGenerator, chirpsSequence),
+			Body:      body,
+			AuthorId:  authorId,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		dbStructure.PutChirp(newChirp)
+		return nil
+	})
 
 	if err != nil {
-		return Chirp{}, ErrDatabaseLoad
+		return Chirp{}, err
 	}
 
-	lastId := 0
-	for key := range dbStructure.Chirps {
-		if key > lastId {
-			lastId = key
+	return newChirp, nil
+}
+
+func (db *DB) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirps = make([]Chirp, 0, len(dbStructure.Chirps))
+
+		for _, chirp := range dbStructure.Chirps {
+			if chirp.DeletedAt == nil {
+				chirps = append(chirps, chirp)
+			}
 		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	nextId := lastId + 1
+	return chirps, nil
+}
 
-	newChirp := Chirp{
-		Id:       nextId,
-		Body:     body,
-		AuthorId: authorId,
-	}
+func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	var chirps []Chirp
 
-	dbStructure.Chirps[nextId] = newChirp
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirpIds := dbStructure.idx.chirpIdsByAuthor[authorId]
+		chirps = make([]Chirp, 0, len(chirpIds))
 
-	err = db.writeDB(dbStructure)
+		for _, chirpId := range chirpIds {
+			if chirp := dbStructure.Chirps[chirpId]; chirp.DeletedAt == nil {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
 
 	if err != nil {
-		return Chirp{}, ErrDatabaseWrite
+		return nil, err
 	}
 
-	return newChirp, nil
+	return chirps, nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+// ChirpQuery selects live chirps in id order, or in creation order, a page
+// at a time.
+type ChirpQuery struct {
+	// AuthorId limits the query to one author's chirps when it isn't 0.
+	AuthorId   int
+	Descending bool
+	// ByCreatedAt orders chirps by CreatedAt, breaking ties by id.
+	ByCreatedAt bool
+	// AfterId starts the page just past this id in the query's order, or
+	// at the first chirp when it's 0. Ordered by CreatedAt, the page starts
+	// past AfterCreatedAt as well, which is that chirp's creation time.
+	AfterId        int
+	AfterCreatedAt time.Time
+	// Since and Until bound CreatedAt to [Since, Until) when they're set.
+	Since time.Time
+	Until time.Time
+	// Limit caps the page size, or returns every match when it's 0.
+	Limit int
+	// IncludeDeleted lists soft-deleted chirps along with live ones.
+	IncludeDeleted bool
+}
 
-	if err != nil {
-		return nil, ErrDatabaseLoad
+func (query ChirpQuery) matches(chirp Chirp) bool {
+	if chirp.DeletedAt != nil && !query.IncludeDeleted {
+		return false
+	}
+	if query.AuthorId != 0 && chirp.AuthorId != query.AuthorId {
+		return false
 	}
+	if !query.Since.IsZero() && chirp.CreatedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !chirp.CreatedAt.Before(query.Until) {
+		return false
+	}
+	return true
+}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
+// ListChirps returns the chirps matching query. It walks the id or creation
+// index from the query's starting point, so a page costs its own size rather
+// than the size of the table. Ordered by creation, one author's chirps are
+// picked out of everyone's as the walk goes.
+func (db *DB) ListChirps(query ChirpQuery) ([]Chirp, error) {
+	chirps := []Chirp{}
 
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
+	err := db.View(func(dbStructure *DBStructure) error {
+		var n, i int
+		var ok bool
+		var chirpIdAt func(i int) int
+		if query.ByCreatedAt {
+			keys := dbStructure.idx.chirpsByCreatedAt
+			n, chirpIdAt = len(keys), func(i int) int { return keys[i].id }
+			i, ok = slices.BinarySearchFunc(keys, chirpKey{createdAt: query.AfterCreatedAt, id: query.AfterId}, compareChirpKeys)
+		} else {
+			chirpIds := dbStructure.idx.chirpIds
+			if query.AuthorId != 0 {
+				chirpIds = dbStructure.idx.chirpIdsByAuthor[query.AuthorId]
+			}
+			n, chirpIdAt = len(chirpIds), func(i int) int { return chirpIds[i] }
+			i, ok = slices.BinarySearch(chirpIds, query.AfterId)
+		}
+
+		start, step := 0, 1
+		if query.Descending {
+			start, step = n-1, -1
+		}
+		if query.AfterId != 0 {
+			switch {
+			case query.Descending:
+				start = i - 1
+			case ok:
+				start = i + 1
+			default:
+				start = i
+			}
+		}
+
+		for i := start; i >= 0 && i < n; i += step {
+			if query.Limit != 0 && len(chirps) == query.Limit {
+				break
+			}
+			if chirp := dbStructure.Chirps[chirpIdAt(i)]; query.matches(chirp) {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return chirps, nil
 }
 
 func (db *DB) GetChirpById(chirpId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+	var chirp Chirp
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[chirpId]
+
+		if !ok || chirp.DeletedAt != nil {
+			return ErrChirpDoesNotExist
+		}
+		return nil
+	})
 
 	if err != nil {
-		return Chirp{}, ErrDatabaseLoad
+		return Chirp{}, err
 	}
 
-	chirp, ok := dbStructure.Chirps[chirpId]
+	return chirp, nil
+}
+
+func (db *DB) GetDeletedChirpById(chirpId int) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[chirpId]
 
-	if !ok {
-		return Chirp{}, ErrChirpDoesNotExist
+		if !ok || chirp.DeletedAt == nil {
+			return ErrChirpDoesNotExist
+		}
+		return nil
+	})
+
+	if err != nil {
+		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
 func (db *DB) DeleteChirpById(chirpId int) error {
-	dbStructure, err := db.loadDB()
+	return db.Update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok || chirp.DeletedAt != nil {
+			return nil
+		}
+
+		deletedAt := time.Now().UTC()
+		chirp.DeletedAt = &deletedAt
+		chirp.UpdatedAt = deletedAt
+		dbStructure.PutChirp(chirp)
+		return nil
+	})
+}
+
+func (db *DB) RestoreChirpById(chirpId int) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[chirpId]
+
+		if !ok || chirp.DeletedAt == nil {
+			return ErrChirpDoesNotExist
+		}
+
+		chirp.DeletedAt = nil
+		chirp.UpdatedAt = time.Now().UTC()
+		dbStructure.PutChirp(chirp)
+		return nil
+	})
 
 	if err != nil {
-		return ErrDatabaseLoad
+		return Chirp{}, err
 	}
 
-	delete(dbStructure.Chirps, chirpId)
+	return chirp, nil
+}
+
+// PurgeDeletedChirps permanently removes chirps soft-deleted before cutoff
+// and reports how many were removed.
+func (db *DB) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	purged := 0
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		for chirpId, chirp := range dbStructure.Chirps {
+			if chirp.DeletedAt != nil && chirp.DeletedAt.Before(cutoff) {
+				dbStructure.DeleteChirp(chirpId)
+				purged++
+			}
+		}
+		return nil
+	})
 
-	err = db.writeDB(dbStructure)
 	if err != nil {
-		return ErrDatabaseWrite
+		return 0, err
 	}
 
-	return nil
+	return purged, nil
 }
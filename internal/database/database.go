@@ -1,106 +1,554 @@
 package database
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 type DB struct {
 	path string
 	mu   *sync.RWMutex
+	opts Options
+	lock *os.File
+	aead cipher.AEAD
+
+	data DBStructure
+
+	wal             *os.File
+	walSize         int64
+	walTransactions int
+
+	compactMu sync.Mutex
+	compactCh chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	feed
+}
+
+type Options struct {
+	// Debug discards any existing data and starts from an empty database.
+	Debug bool
+	// CompactInterval is how often the write-ahead log is folded into the
+	// snapshot. Defaults to defaultCompactInterval.
+	CompactInterval time.Duration
+	// CompactThreshold triggers a compaction once the log holds this many
+	// transactions. Defaults to defaultCompactThreshold.
+	CompactThreshold int
+	// EncryptionKey, when set, encrypts the snapshot, its backup and the log
+	// with AES-256-GCM. See ParseEncryptionKey.
+	EncryptionKey []byte
+	// AllowPlaintext reads files and log lines that aren't encrypted even
+	// though EncryptionKey is set, so Rekey can encrypt an existing database.
+	// Without it they are rejected with ErrDatabaseNotEncrypted.
+	AllowPlaintext bool
+	// IDGenerator issues ids for new chirps and users. Defaults to
+	// SequenceGenerator.
+	IDGenerator IDGenerator
+	// ReadOnly takes a shared lock instead of an exclusive one, so several
+	// readers can open the database while no writer has it open.
+	ReadOnly bool
 }
 
 type DBStructure struct {
+	SchemaVersion int                     `json:"schema_version"`
 	Chirps        map[int]Chirp           `json:"chirps"`
 	Users         map[int]User            `json:"users"`
 	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	// RevokedAccessTokens is the access token denylist, keyed by token id.
+	RevokedAccessTokens map[string]RevokedAccessToken `json:"revoked_access_tokens"`
+	// Sequences holds the highest id ever issued per kind of record.
+	Sequences map[string]int `json:"sequences"`
+
+	tx  *txLog
+	idx *indexes
 }
 
+const (
+	defaultCompactInterval  = 5 * time.Minute
+	defaultCompactThreshold = 1000
+)
+
 var ErrDatabaseLoad = errors.New("Error loading database")
 var ErrDatabaseWrite = errors.New("Error writing to database")
+var ErrDatabaseCorrupt = errors.New("Database file is corrupt")
+var ErrDatabaseLocked = errors.New("Database is in use by another process")
+var ErrReadOnly = errors.New("Database is open read-only")
+
+var errEmptyDBFile = errors.New("database file is empty")
 
 func NewDB(path string, debug bool) (*DB, error) {
+	return Open(path, Options{Debug: debug})
+}
+
+func Open(path string, opts Options) (*DB, error) {
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = defaultCompactInterval
+	}
+
+	if opts.CompactThreshold <= 0 {
+		opts.CompactThreshold = defaultCompactThreshold
+	}
+
+	if opts.IDGenerator == nil {
+		opts.IDGenerator = SequenceGenerator{}
+	}
+
+	if opts.ReadOnly && opts.Debug {
+		return nil, errors.New("debug mode needs a writable database")
+	}
+
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:      path,
+		mu:        &sync.RWMutex{},
+		opts:      opts,
+		compactCh: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	aead, err := newAEAD(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
 	}
 
-	err := db.ensureDB(debug)
-	return db, err
+	db.aead = aead
+
+	lock, err := acquireLock(db.lockPath(), opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock = lock
+
+	err = db.load()
+	if err != nil {
+		releaseLock(lock)
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		close(db.done)
+	} else {
+		go db.compactLoop()
+	}
+
+	return db, nil
 }
 
-func (db *DB) ensureDB(debug bool) error {
-	openFileFlags := os.O_RDWR | os.O_CREATE
-	if debug {
-		openFileFlags |= os.O_TRUNC
+func (db *DB) load() error {
+	data, version, err := db.ensureDB(db.opts.Debug)
+	if err != nil {
+		return err
 	}
 
-	file, err := os.OpenFile(db.path, openFileFlags, 0666)
+	if db.opts.Debug {
+		os.Remove(db.walPath())
+	}
 
+	if version < LatestSchemaVersion() && !db.opts.ReadOnly {
+		err = db.migrateSnapshot(data, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	data.syncSequences()
+	data.buildIndexes()
+
+	transactions, offset, err := replayLog(db.walPath(), db.aead, db.opts.AllowPlaintext, &data)
 	if err != nil {
-		return fmt.Errorf("problem opening %s, %v", db.path, err)
+		return err
 	}
 
-	defer file.Close()
+	db.data = data
 
-	info, err := file.Stat()
+	if db.opts.ReadOnly {
+		return nil
+	}
 
+	db.wal, err = os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		return fmt.Errorf("problem getting file info from the file %s, %v", file.Name(), err)
+		return fmt.Errorf("problem opening %s, %v", db.walPath(), err)
+	}
+
+	err = db.wal.Truncate(offset)
+	if err != nil {
+		db.wal.Close()
+		return fmt.Errorf("problem truncating %s, %v", db.walPath(), err)
+	}
+
+	db.walSize = offset
+	db.walTransactions = transactions
+	return nil
+}
+
+func (db *DB) ensureDB(debug bool) (DBStructure, int, error) {
+	if !db.opts.ReadOnly {
+		db.removeTempFiles()
+
+		if debug {
+			return newDBStructure(), LatestSchemaVersion(), db.writeDB(newDBStructure())
+		}
+	}
+
+	dbStructure, version, err := db.loadDB()
+	if err == nil || errors.Is(err, ErrSchemaTooNew) || isKeyError(err) {
+		return dbStructure, version, err
+	}
+
+	// A missing or empty snapshot is a new database only if nothing was ever
+	// written next to it; otherwise it was lost and the backup is needed.
+	missing := errors.Is(err, errEmptyDBFile) || errors.Is(err, fs.ErrNotExist)
+	if missing && !hasData(db.backupPath()) && !hasData(db.walPath()) {
+		if db.opts.ReadOnly {
+			return dbStructure, version, err
+		}
+		return newDBStructure(), LatestSchemaVersion(), db.writeDB(newDBStructure())
 	}
 
-	if info.Size() == 0 || debug {
-		err = json.NewEncoder(file).Encode(DBStructure{
-			Chirps:        map[int]Chirp{},
-			Users:         map[int]User{},
-			RefreshTokens: map[string]RefreshToken{},
-		})
+	// The log holds changes made after the snapshot, which may be newer than
+	// the backup: replaying it there would skip what the last compaction
+	// folded in.
+	if hasData(db.walPath()) {
+		return DBStructure{}, 0, fmt.Errorf("%w: %s: %v, and %s holds changes that can't be replayed on its backup", ErrDatabaseCorrupt, db.path, err, db.walPath())
+	}
 
+	backup, version, backupErr := readDBFile(db.backupPath(), db.aead, db.opts.AllowPlaintext)
+	if backupErr != nil {
+		return DBStructure{}, 0, fmt.Errorf("%w: %s: %v, and no usable backup at %s: %v", ErrDatabaseCorrupt, db.path, err, db.backupPath(), backupErr)
+	}
+
+	if db.opts.ReadOnly {
+		return backup, version, nil
+	}
+
+	log.Printf("Database %s unreadable (%v), restoring from %s", db.path, err, db.backupPath())
+	return backup, version, db.restoreBackup(backup, !missing)
+}
+
+// restoreBackup rewrites the snapshot from its backup. Unlike writeDB it
+// leaves the backup alone, since it is the only good copy, and moves an
+// unreadable snapshot aside rather than deleting it.
+func (db *DB) restoreBackup(backup DBStructure, keepCorrupt bool) error {
+	if keepCorrupt {
+		corruptPath := fmt.Sprintf("%s.corrupt-%s", db.path, time.Now().UTC().Format("20060102T150405Z"))
+		err := os.Rename(db.path, corruptPath)
 		if err != nil {
-			return fmt.Errorf("problem encoding %s, %v", db.path, err)
+			return fmt.Errorf("problem moving %s aside, %v", db.path, err)
 		}
+		log.Printf("Moved unreadable database %s to %s", db.path, corruptPath)
+	}
+
+	data, err := encodeDB(backup, db.aead)
+	if err != nil {
+		return fmt.Errorf("problem encoding %s, %v", db.path, err)
+	}
+
+	return replaceFile(db.path, data)
+}
+
+// hasData reports whether path exists and isn't empty.
+func hasData(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
+
+// migrateSnapshot persists a freshly migrated snapshot. Log entries are
+// written in the schema of the binary that wrote them, so a log left behind
+// by an older version cannot be replayed on top of a migrated snapshot.
+func (db *DB) migrateSnapshot(data DBStructure, from int) error {
+	if hasData(db.walPath()) {
+		return fmt.Errorf("%s holds changes from schema version %d; start the previous version once to compact it before migrating", db.walPath(), from)
+	}
+
+	err := db.writeDB(data)
+	if err != nil {
+		return err
 	}
 
+	log.Printf("Migrated database %s from schema version %d to %d", db.path, from, LatestSchemaVersion())
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
+// View passes the cached state to fn. fn must not modify it or keep
+// references to it after returning.
+func (db *DB) View(fn func(*DBStructure) error) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	file, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0666)
 
+	return fn(&db.data)
+}
+
+// Update runs fn against the cached state and makes its changes durable in
+// the write-ahead log before returning. fn must change the state through the
+// DBStructure Put and Delete methods; if fn fails, or the log cannot be
+// written, every change is rolled back.
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// Deliver the queued events once the lock is released.
+	defer db.flush()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data.begin()
+
+	err := fn(&db.data)
 	if err != nil {
-		return DBStructure{}, fmt.Errorf("problem opening %s, %v", db.path, err)
+		db.data.rollback()
+		return err
 	}
 
-	var dbStructure DBStructure
+	entries := db.data.tx.entries
+	if len(entries) == 0 {
+		db.data.commit()
+		return nil
+	}
 
-	err = json.NewDecoder(file).Decode(&dbStructure)
+	err = db.appendLog(entries)
+	if err != nil {
+		log.Printf("Error writing database log: %v", err)
+		db.data.rollback()
+		return ErrDatabaseWrite
+	}
+
+	db.queue(eventsFor(db.data.tx)...)
+	db.data.commit()
+
+	if db.walTransactions >= db.opts.CompactThreshold {
+		select {
+		case db.compactCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Compact writes the cached state as a new snapshot and empties the log.
+// Replaying the log is idempotent, so a crash between the two steps only
+// means the next start replays changes the snapshot already holds.
+func (db *DB) Compact() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.compact()
+}
+
+// compact folds the log into the snapshot. Callers hold compactMu and at
+// least a read lock on mu.
+func (db *DB) compact() error {
+	if db.walTransactions == 0 {
+		return nil
+	}
+
+	err := db.writeDB(db.data)
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	err = db.wal.Truncate(0)
+	if err == nil {
+		err = db.wal.Sync()
+	}
 
 	if err != nil {
-		return DBStructure{}, fmt.Errorf("problem parsing db, %v", err)
+		return fmt.Errorf("problem truncating %s, %v", db.walPath(), err)
 	}
 
-	return dbStructure, nil
+	db.walSize = 0
+	db.walTransactions = 0
+	return nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	file, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0666)
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		db.closeErr = db.close()
+	})
+	return db.closeErr
+}
 
+func (db *DB) close() error {
+	close(db.stop)
+	<-db.done
+	defer releaseLock(db.lock)
+	defer db.closeSubscribers()
+
+	if db.opts.ReadOnly {
+		return nil
+	}
+
+	err := db.Compact()
 	if err != nil {
-		return fmt.Errorf("problem opening %s, %v", db.path, err)
+		db.wal.Close()
+		return err
 	}
 
-	err = json.NewEncoder(file).Encode(dbStructure)
+	return db.wal.Close()
+}
+
+func (db *DB) compactLoop() {
+	defer close(db.done)
+
+	ticker := time.NewTicker(db.opts.CompactInterval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+		case <-db.compactCh:
+		}
+
+		err := db.Compact()
+		if err != nil {
+			log.Printf("Error compacting database %s: %v", db.path, err)
+		}
+	}
+}
+
+func (db *DB) loadDB() (DBStructure, int, error) {
+	return readDBFile(db.path, db.aead, db.opts.AllowPlaintext)
+}
+
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	data, err := encodeDB(dbStructure, db.aead)
 	if err != nil {
 		return fmt.Errorf("problem encoding %s, %v", db.path, err)
 	}
 
+	// Keep the previous version reachable as a backup; a hard link costs no copy.
+	os.Remove(db.backupPath())
+	os.Link(db.path, db.backupPath())
+
+	return replaceFile(db.path, data)
+}
+
+func encodeDB(dbStructure DBStructure, aead cipher.AEAD) ([]byte, error) {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, data)
+}
+
+// replaceFile writes data to a temp file next to path and renames it over
+// path, so readers see either the old or the new contents.
+func replaceFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+
+	if err != nil {
+		return fmt.Errorf("problem creating temp file in %s, %v", dir, err)
+	}
+
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("problem writing %s, %v", file.Name(), err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("problem replacing %s, %v", path, err)
+	}
+
+	return syncDir(dir)
+}
+
+func (db *DB) lockPath() string {
+	return db.path + ".lock"
+}
+
+func (db *DB) backupPath() string {
+	return db.path + ".bak"
+}
+
+func (db *DB) removeTempFiles() {
+	matches, _ := filepath.Glob(db.path + ".tmp-*")
+	backupMatches, _ := filepath.Glob(db.backupPath() + ".tmp-*")
+	matches = append(matches, backupMatches...)
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		SchemaVersion: LatestSchemaVersion(),
+		Chirps:        map[int]Chirp{},
+		Users:         map[int]User{},
+		RefreshTokens: map[string]RefreshToken{},
+		Sequences:     map[string]int{},
+
+		RevokedAccessTokens: map[string]RevokedAccessToken{},
+	}
+}
+
+// readDBFile loads a database file, migrating it to the latest schema, and
+// returns the schema version it was stored at.
+func readDBFile(path string, aead cipher.AEAD, allowPlaintext bool) (DBStructure, int, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return DBStructure{}, 0, fmt.Errorf("problem opening %s, %w", path, err)
+	}
+
+	if len(data) == 0 {
+		return DBStructure{}, 0, errEmptyDBFile
+	}
+
+	data, err = unseal(aead, data, allowPlaintext)
+	if err != nil {
+		return DBStructure{}, 0, err
+	}
+
+	return migrateDocument(data)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("problem opening %s, %v", dir, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("problem syncing %s, %v", dir, err)
+	}
+
 	return nil
 }
@@ -0,0 +1,1469 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestConcurrentCreateChirp(t *testing.T) {
+	db := newTestDB(t)
+	const writers = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CreateChirp("hello", 1)
+			if err != nil {
+				t.Errorf("error creating chirp: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatalf("error getting chirps: %v", err)
+	}
+
+	if len(chirps) != writers {
+		t.Errorf("Chirps, got: %d, want: %d", len(chirps), writers)
+	}
+}
+
+func TestConcurrentCreateUserRejectsDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	const writers = 20
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CreateUser("user@example.com", "hash")
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			} else if err != ErrUserAlreadyExists {
+				t.Errorf("error creating user: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("Users created, got: %d, want: 1", created)
+	}
+}
+
+func TestWriteDBShrinkingFile(t *testing.T) {
+	db := newTestDB(t)
+
+	chirp, err := db.CreateChirp(strings.Repeat("a", 140), 1)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	err = db.Compact()
+	if err != nil {
+		t.Fatalf("error compacting database: %v", err)
+	}
+
+	err = db.DeleteChirpById(chirp.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	err = db.Compact()
+	if err != nil {
+		t.Fatalf("error compacting database: %v", err)
+	}
+
+	_, _, err = readDBFile(db.path, nil, false)
+	if err != nil {
+		t.Errorf("error reading database after shrinking write: %v", err)
+	}
+}
+
+func TestEnsureDBCorruptFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		contents   string
+		withBackup bool
+		wantErr    error
+		wantUser   bool
+	}{
+		{name: "recovers from backup", contents: `{"chirps":{"1":`, withBackup: true, wantErr: nil, wantUser: true},
+		{name: "refuses to start without backup", contents: `{"chirps":{"1":`, withBackup: false, wantErr: ErrDatabaseCorrupt},
+		{name: "recovers an emptied file from backup", contents: "", withBackup: true, wantErr: nil, wantUser: true},
+		{name: "starts fresh from an empty file without backup", contents: "", withBackup: false, wantErr: nil, wantUser: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+
+			_, err := db.CreateUser("user@example.com", "hash")
+			if err != nil {
+				t.Fatalf("error creating user: %v", err)
+			}
+
+			err = db.Compact()
+			if err != nil {
+				t.Fatalf("error compacting database: %v", err)
+			}
+
+			_, err = db.CreateChirp("hello", 1)
+			if err != nil {
+				t.Fatalf("error creating chirp: %v", err)
+			}
+
+			err = db.Compact()
+			if err != nil {
+				t.Fatalf("error compacting database: %v", err)
+			}
+
+			db.Close()
+
+			if !tt.withBackup {
+				os.Remove(db.backupPath())
+			}
+
+			err = os.WriteFile(db.path, []byte(tt.contents), 0666)
+			if err != nil {
+				t.Fatalf("error corrupting database: %v", err)
+			}
+
+			reopened, err := NewDB(db.path, false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewDB, got: %v, want: %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+			defer reopened.Close()
+
+			_, err = reopened.GetUserByEmail("user@example.com")
+			if (err == nil) != tt.wantUser {
+				t.Errorf("GetUserByEmail after reopening, got: %v, want user: %v", err, tt.wantUser)
+			}
+
+			if !tt.withBackup {
+				return
+			}
+
+			// Recovering must not replace the only good copy with the bad one.
+			backup, _, err := readDBFile(db.backupPath(), nil, false)
+			if err != nil || len(backup.Users) != 1 {
+				t.Errorf("backup after recovery, got: %d users, %v, want: 1 user", len(backup.Users), err)
+			}
+		})
+	}
+}
+
+func TestEnsureDBCorruptFileWithLog(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	db.CreateChirp("compacted into the backup", 1)
+	db.Compact()
+	db.CreateChirp("compacted into the snapshot", 1)
+	db.Compact()
+	db.CreateChirp("in the log", 1)
+
+	// Crash before the last chirp is compacted.
+	close(db.stop)
+	<-db.done
+	db.wal.Close()
+	releaseLock(db.lock)
+
+	err = os.WriteFile(db.path, []byte(`{"chirps":{"1":`), 0666)
+	if err != nil {
+		t.Fatalf("error corrupting database: %v", err)
+	}
+
+	// The backup predates the second chirp, so replaying the log on it would
+	// silently lose an acknowledged write.
+	reopened, err := NewDB(db.path, false)
+	if err == nil {
+		reopened.Close()
+	}
+	if !errors.Is(err, ErrDatabaseCorrupt) {
+		t.Errorf("NewDB, got: %v, want: %v", err, ErrDatabaseCorrupt)
+	}
+}
+
+func TestReplayLogAfterCrash(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	chirp, err := db.CreateChirp("hello", user.Id)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	onDisk, _, err := readDBFile(db.path, nil, false)
+	if err != nil {
+		t.Fatalf("error reading database: %v", err)
+	}
+
+	if len(onDisk.Chirps) != 0 {
+		t.Errorf("Chirps in snapshot before compaction, got: %d, want: 0", len(onDisk.Chirps))
+	}
+
+	// Crash in the middle of a write: leave a torn line and skip compaction.
+	_, err = db.wal.Write([]byte(`[{"op":"put_chirp","chirp":{"id":`))
+	if err != nil {
+		t.Fatalf("error appending torn line: %v", err)
+	}
+	close(db.stop)
+	<-db.done
+	db.wal.Close()
+	releaseLock(db.lock)
+
+	reopened, err := NewDB(db.path, false)
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+
+	_, err = reopened.GetChirpById(chirp.Id)
+	if err != nil {
+		t.Errorf("error reading replayed chirp: %v", err)
+	}
+
+	_, err = reopened.GetUserByEmail(user.Email)
+	if err != nil {
+		t.Errorf("error reading replayed user: %v", err)
+	}
+
+	_, err = reopened.CreateChirp("after crash", user.Id)
+	if err != nil {
+		t.Fatalf("error creating chirp after replay: %v", err)
+	}
+
+	err = reopened.Close()
+	if err != nil {
+		t.Fatalf("error closing database: %v", err)
+	}
+
+	onDisk, _, err = readDBFile(db.path, nil, false)
+	if err != nil {
+		t.Fatalf("error reading database: %v", err)
+	}
+
+	if len(onDisk.Chirps) != 2 {
+		t.Errorf("Chirps in snapshot after close, got: %d, want: 2", len(onDisk.Chirps))
+	}
+
+	info, err := os.Stat(db.walPath())
+	if err != nil || info.Size() != 0 {
+		t.Errorf("Log after close, got: %v, %v, want empty", info, err)
+	}
+}
+
+func seedChirps(b *testing.B, n int) string {
+	b.Helper()
+
+	path := filepath.Join(b.TempDir(), "database.json")
+	dbStructure := newDBStructure()
+	for id := 1; id <= n; id++ {
+		dbStructure.Chirps[id] = Chirp{Id: id, Body: "The quick brown fox jumps over the lazy dog", AuthorId: id % 100}
+	}
+
+	db := &DB{path: path}
+	err := db.writeDB(dbStructure)
+	if err != nil {
+		b.Fatalf("error seeding database: %v", err)
+	}
+	return path
+}
+
+func BenchmarkGetChirpById(b *testing.B) {
+	const chirps = 50_000
+	path := seedChirps(b, chirps)
+
+	b.Run("cached", func(b *testing.B) {
+		db, err := NewDB(path, false)
+		if err != nil {
+			b.Fatalf("error opening database: %v", err)
+		}
+		defer db.Close()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, err := db.GetChirpById(i%chirps + 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("load-per-call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dbStructure, _, err := readDBFile(path, nil, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = dbStructure.Chirps[i%chirps+1]
+		}
+	})
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	db := newTestDB(t)
+
+	alice, _ := db.CreateUser("alice@example.com", "hash")
+	bob, _ := db.CreateUser("bob@example.com", "hash")
+	first, _ := db.CreateChirp("first", alice.Id)
+	db.CreateChirp("second", bob.Id)
+	db.CreateChirp("third", alice.Id)
+	db.CreateRefreshToken(alice.Id, "alice-token", time.Now().UTC(), Client{})
+
+	err := db.DeleteChirpById(first.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	_, err = db.UpdateUserEmailPasswordById(alice.Id, "alice@example.org", "hash")
+	if err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+
+	_, err = db.UpdateUserEmailPasswordById(bob.Id, "alice@example.org", "hash")
+	if err != ErrUserAlreadyExists {
+		t.Errorf("taking another user's email, got: %v, want: %v", err, ErrUserAlreadyExists)
+	}
+
+	chirps, err := db.GetChirpsByAuthor(alice.Id)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "third" {
+		t.Errorf("GetChirpsByAuthor, got: %+v, %v", chirps, err)
+	}
+
+	_, err = db.GetUserByEmail("alice@example.com")
+	if err != ErrUserDoesNotExist {
+		t.Errorf("GetUserByEmail with old email, got: %v, want: %v", err, ErrUserDoesNotExist)
+	}
+
+	user, err := db.GetUserByEmail("alice@example.org")
+	if err != nil || user.Id != alice.Id {
+		t.Errorf("GetUserByEmail with new email, got: %+v, %v", user, err)
+	}
+
+	user, err = db.GetUserByEmail("bob@example.com")
+	if err != nil || user.Id != bob.Id {
+		t.Errorf("GetUserByEmail after rolled back update, got: %+v, %v", user, err)
+	}
+
+	refreshTokens, err := db.GetRefreshTokensByUser(alice.Id)
+	if err != nil || len(refreshTokens) != 1 {
+		t.Errorf("GetRefreshTokensByUser, got: %+v, %v", refreshTokens, err)
+	}
+}
+
+func TestListChirps(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	// Creation order is 2, 4 and 5 together, 3, then 1.
+	base := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	createdAt := map[int]time.Time{1: base.Add(3 * time.Hour), 2: base, 3: base.Add(2 * time.Hour), 4: base.Add(time.Hour), 5: base.Add(time.Hour)}
+
+	tests := []struct {
+		name  string
+		query ChirpQuery
+		want  []int
+	}{
+		{name: "lists every live chirp", query: ChirpQuery{}, want: []int{1, 2, 4, 5}},
+		{name: "lists descending", query: ChirpQuery{Descending: true}, want: []int{5, 4, 2, 1}},
+		{name: "limits the page", query: ChirpQuery{Limit: 2}, want: []int{1, 2}},
+		{name: "starts after an id", query: ChirpQuery{AfterId: 2, Limit: 2}, want: []int{4, 5}},
+		{name: "starts after an id descending", query: ChirpQuery{AfterId: 4, Descending: true, Limit: 2}, want: []int{2, 1}},
+		{name: "starts after a deleted id", query: ChirpQuery{AfterId: 3}, want: []int{4, 5}},
+		{name: "starts after an id past the end", query: ChirpQuery{AfterId: 10, Descending: true}, want: []int{5, 4, 2, 1}},
+		{name: "filters by author", query: ChirpQuery{AuthorId: 1, AfterId: 1}, want: []int{4}},
+		{name: "filters by creation time", query: ChirpQuery{Since: time.Now().Add(time.Hour)}, want: []int{}},
+		{name: "orders by creation time", query: ChirpQuery{ByCreatedAt: true}, want: []int{2, 4, 5, 1}},
+		{name: "orders by creation time descending", query: ChirpQuery{ByCreatedAt: true, Descending: true}, want: []int{1, 5, 4, 2}},
+		{name: "starts after a tie in creation time", query: ChirpQuery{ByCreatedAt: true, AfterId: 4, AfterCreatedAt: createdAt[4], Limit: 2}, want: []int{5, 1}},
+		{name: "starts after a tie in creation time descending", query: ChirpQuery{ByCreatedAt: true, Descending: true, AfterId: 5, AfterCreatedAt: createdAt[5]}, want: []int{4, 2}},
+		{name: "starts after a deleted chirp in creation time", query: ChirpQuery{ByCreatedAt: true, AfterId: 3, AfterCreatedAt: createdAt[3]}, want: []int{1}},
+		{name: "filters by author in creation time", query: ChirpQuery{ByCreatedAt: true, AuthorId: 1}, want: []int{4, 1}},
+		{name: "includes deleted chirps", query: ChirpQuery{IncludeDeleted: true}, want: []int{1, 2, 3, 4, 5}},
+		{name: "includes deleted chirps in creation time", query: ChirpQuery{ByCreatedAt: true, IncludeDeleted: true, AfterId: 5, AfterCreatedAt: createdAt[5]}, want: []int{3, 1}},
+	}
+
+	for name, store := range stores {
+		alice, _ := store.CreateUser("alice@example.com", "hash")
+		bob, _ := store.CreateUser("bob@example.com", "hash")
+		for _, authorId := range []int{alice.Id, bob.Id, alice.Id, alice.Id, bob.Id} {
+			chirp, _ := store.CreateChirp("chirp", authorId)
+			chirp.CreatedAt = createdAt[chirp.Id]
+			store.Apply(Event{Type: ChirpUpdated, Chirp: &chirp})
+		}
+		store.DeleteChirpById(3)
+
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				chirps, err := store.ListChirps(tt.query)
+				if err != nil {
+					t.Fatalf("error listing chirps: %v", err)
+				}
+
+				got := []int{}
+				for _, chirp := range chirps {
+					got = append(got, chirp.Id)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("ListChirps(%+v), got: %v, want: %v", tt.query, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+			store.CreateUser(email, "hash")
+		}
+
+		pages := [][]int{}
+		for afterId := 0; ; {
+			users, err := store.ListUsers(afterId, 2)
+			if err != nil {
+				t.Fatalf("%s: error listing users: %v", name, err)
+			}
+			if len(users) == 0 {
+				break
+			}
+
+			page := []int{}
+			for _, user := range users {
+				page = append(page, user.Id)
+			}
+			pages = append(pages, page)
+			afterId = users[len(users)-1].Id
+		}
+
+		if !reflect.DeepEqual(pages, [][]int{{1, 2}, {3}}) {
+			t.Errorf("%s: ListUsers pages, got: %v, want: [[1 2] [3]]", name, pages)
+		}
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			expiresAt := time.Now().UTC().Add(time.Hour)
+			store.CreateRefreshToken(user.Id, "first", expiresAt, Client{})
+			store.CreateRefreshToken(user.Id, "other-login", expiresAt, Client{})
+			store.CreateRefreshToken(user.Id, "expired", time.Now().UTC().Add(-time.Hour), Client{})
+
+			gotUser, second, err := store.RotateRefreshToken("first", "second", expiresAt, Client{})
+			if err != nil || gotUser.Id != user.Id || second.TokenHash != hashRefreshToken("second") || second.FamilyId == "" {
+				t.Fatalf("RotateRefreshToken, got: %+v, %+v, %v", gotUser, second, err)
+			}
+
+			_, third, err := store.RotateRefreshToken("second", "third", expiresAt, Client{UserAgent: "curl", IP: "192.0.2.1"})
+			if err != nil || third.FamilyId != second.FamilyId {
+				t.Fatalf("RotateRefreshToken of the new token, got: %+v, %v, want family %s", third, err, second.FamilyId)
+			}
+
+			if !third.CreatedAt.Equal(second.CreatedAt) || third.LastUsedAt.Before(second.LastUsedAt) || third.UserAgent != "curl" || third.IP != "192.0.2.1" {
+				t.Errorf("RotateRefreshToken session metadata, got: %+v, want the family's creation time and the new client", third)
+			}
+
+			_, _, err = store.RotateRefreshToken("expired", "never", expiresAt, Client{})
+			if err != ErrRefreshTokenExpired {
+				t.Errorf("RotateRefreshToken of an expired token, got: %v, want: %v", err, ErrRefreshTokenExpired)
+			}
+
+			_, reused, err := store.RotateRefreshToken("first", "stolen", expiresAt, Client{})
+			if err != ErrRefreshTokenReused || reused.FamilyId != second.FamilyId {
+				t.Errorf("RotateRefreshToken of a rotated token, got: %+v, %v, want: %v", reused, err, ErrRefreshTokenReused)
+			}
+
+			for _, token := range []string{"first", "second", "third", "stolen"} {
+				_, _, err = store.GetUserAndRefreshTokenByRefreshToken(token)
+				if err != ErrRefreshTokenDoesNotExist {
+					t.Errorf("token %s after reuse, got: %v, want: %v", token, err, ErrRefreshTokenDoesNotExist)
+				}
+			}
+
+			_, _, err = store.GetUserAndRefreshTokenByRefreshToken("other-login")
+			if err != nil {
+				t.Errorf("token from another login after reuse, got: %v, want it kept", err)
+			}
+		})
+	}
+}
+
+func TestRevokeRefreshTokens(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			other, _ := store.CreateUser("other@example.com", "hash")
+			expiresAt := time.Now().UTC().Add(time.Hour)
+			store.CreateRefreshToken(user.Id, "laptop", expiresAt, Client{})
+			store.CreateRefreshToken(user.Id, "phone", expiresAt, Client{})
+			store.CreateRefreshToken(user.Id, "tablet", expiresAt, Client{})
+			store.CreateRefreshToken(other.Id, "other", expiresAt, Client{})
+			store.RotateRefreshToken("laptop", "laptop-rotated", expiresAt, Client{})
+			store.RotateRefreshToken("tablet", "tablet-rotated", expiresAt, Client{})
+			store.CreateRefreshToken(user.Id, "expired", time.Now().UTC().Add(-time.Hour), Client{})
+
+			_, laptop, _ := store.GetUserAndRefreshTokenByRefreshToken("laptop-rotated")
+			_, otherToken, _ := store.GetUserAndRefreshTokenByRefreshToken("other")
+
+			err := store.RevokeRefreshTokenFamily(user.Id, otherToken.FamilyId)
+			if err != ErrRefreshTokenDoesNotExist {
+				t.Errorf("RevokeRefreshTokenFamily of another user's family, got: %v, want: %v", err, ErrRefreshTokenDoesNotExist)
+			}
+
+			err = store.RevokeRefreshTokenFamily(user.Id, laptop.FamilyId)
+			if err != nil {
+				t.Fatalf("error revoking family: %v", err)
+			}
+
+			for _, token := range []string{"laptop", "laptop-rotated"} {
+				_, _, err = store.GetUserAndRefreshTokenByRefreshToken(token)
+				if err != ErrRefreshTokenDoesNotExist {
+					t.Errorf("token %s after revoking its family, got: %v, want: %v", token, err, ErrRefreshTokenDoesNotExist)
+				}
+			}
+
+			_, phone, _ := store.GetUserAndRefreshTokenByRefreshToken("phone")
+			for familyId, want := range map[string]bool{laptop.FamilyId: false, phone.FamilyId: true, otherToken.FamilyId: false} {
+				active, err := store.IsRefreshTokenFamilyActive(user.Id, familyId)
+				if err != nil || active != want {
+					t.Errorf("IsRefreshTokenFamilyActive(%q), got: %t, %v, want: %t", familyId, active, err, want)
+				}
+			}
+
+			revoked, err := store.RevokeSessionsByUser(user.Id)
+			if err != nil || revoked != 2 {
+				t.Errorf("RevokeSessionsByUser, got: %d, %v, want: 2", revoked, err)
+			}
+
+			if updated, _ := store.GetUserById(user.Id); updated.TokenVersion != 1 {
+				t.Errorf("TokenVersion after revoking all sessions, got: %d, want: 1", updated.TokenVersion)
+			}
+
+			_, err = store.RevokeSessionsByUser(999)
+			if err != ErrUserDoesNotExist {
+				t.Errorf("RevokeSessionsByUser of a missing user, got: %v, want: %v", err, ErrUserDoesNotExist)
+			}
+
+			refreshTokens, _ := store.GetRefreshTokensByUser(user.Id)
+			if len(refreshTokens) != 0 {
+				t.Errorf("GetRefreshTokensByUser after revoking all, got: %+v", refreshTokens)
+			}
+
+			_, _, err = store.GetUserAndRefreshTokenByRefreshToken("other")
+			if err != nil {
+				t.Errorf("another user's token, got: %v, want it kept", err)
+			}
+		})
+	}
+}
+
+func TestPurgeExpiredRefreshTokens(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			now := time.Now().UTC()
+			store.CreateRefreshToken(user.Id, "expired", now.Add(-time.Minute), Client{})
+			store.CreateRefreshToken(user.Id, "rotated", now.Add(time.Hour), Client{})
+			store.RotateRefreshToken("rotated", "current", now.Add(-time.Second), Client{})
+
+			purged, err := store.PurgeExpiredRefreshTokens(now)
+			if err != nil || purged != 2 {
+				t.Errorf("PurgeExpiredRefreshTokens, got: %d, %v, want: 2", purged, err)
+			}
+
+			refreshTokens, _ := store.GetRefreshTokensByUser(user.Id)
+			if len(refreshTokens) != 1 || refreshTokens[0].TokenHash != hashRefreshToken("rotated") {
+				t.Errorf("GetRefreshTokensByUser after purging, got: %+v, want only the unexpired rotated token", refreshTokens)
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			store.CreateChirp("deleted", user.Id)
+			store.DeleteChirpById(1)
+
+			createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			updatedAt := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+			users := []User{{Id: 1, Email: "new@example.com", PasswordHash: "hash", TokenVersion: 2, CreatedAt: createdAt, UpdatedAt: updatedAt}}
+			chirps := []Chirp{{Id: 1, Body: "moved", AuthorId: 1, CreatedAt: createdAt, UpdatedAt: updatedAt}}
+
+			err := store.Import(users, chirps, false)
+			if !errors.Is(err, ErrIdTaken) {
+				t.Errorf("Import with taken ids, got: %v, want: %v", err, ErrIdTaken)
+			}
+
+			store.PurgeDeletedChirps(time.Now().Add(time.Hour))
+			err = store.Import(nil, []Chirp{{Id: 1, Body: "reused", AuthorId: user.Id, CreatedAt: createdAt, UpdatedAt: updatedAt}}, false)
+			if !errors.Is(err, ErrIdTaken) {
+				t.Errorf("Import with the id of a purged chirp, got: %v, want: %v", err, ErrIdTaken)
+			}
+
+			kept := []User{{Id: 7, Email: "kept@example.com", PasswordHash: "hash", CreatedAt: createdAt, UpdatedAt: updatedAt}}
+			err = store.Import(kept, []Chirp{{Id: 8, Body: "kept", AuthorId: 7, CreatedAt: createdAt, UpdatedAt: updatedAt}}, false)
+			if err != nil {
+				t.Fatalf("error importing unissued ids: %v", err)
+			}
+			if chirp, err := store.GetChirpById(8); err != nil || chirp.AuthorId != 7 {
+				t.Errorf("chirp imported with its id, got: %+v, %v", chirp, err)
+			}
+
+			err = store.Import(append(users, User{Id: 9, Email: "user@example.com"}), nil, true)
+			if !errors.Is(err, ErrUserAlreadyExists) {
+				t.Errorf("Import with a taken email, got: %v, want: %v", err, ErrUserAlreadyExists)
+			}
+			if _, err := store.GetUserByEmail("new@example.com"); err != ErrUserDoesNotExist {
+				t.Errorf("GetUserByEmail after a rejected import, got: %v, want: %v", err, ErrUserDoesNotExist)
+			}
+
+			err = store.Import(users, chirps, true)
+			if err != nil {
+				t.Fatalf("error importing: %v", err)
+			}
+
+			got, _ := store.GetUserByEmail("new@example.com")
+			want := User{Id: got.Id, Email: "new@example.com", PasswordHash: "hash", TokenVersion: 2, CreatedAt: createdAt, UpdatedAt: updatedAt}
+			if got.Id == 1 || !reflect.DeepEqual(got, want) {
+				t.Errorf("imported user, got: %+v, want: %+v with a new id", got, want)
+			}
+
+			gotChirps, _ := store.GetChirpsByAuthor(got.Id)
+			wantChirps := []Chirp{{Id: 9, Body: "moved", AuthorId: got.Id, CreatedAt: createdAt, UpdatedAt: updatedAt}}
+			if !reflect.DeepEqual(gotChirps, wantChirps) {
+				t.Errorf("imported chirps, got: %+v, want: %+v", gotChirps, wantChirps)
+			}
+		})
+	}
+}
+
+func TestRevokeAccessTokens(t *testing.T) {
+	sqlitePath := filepath.Join(t.TempDir(), "database.db")
+	sqliteDB, err := NewSQLiteDB(sqlitePath, Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			now := time.Now().UTC()
+			store.RevokeAccessToken("expired", now.Add(-time.Minute))
+			store.RevokeAccessToken("live", now.Add(time.Hour))
+
+			for id, want := range map[string]bool{"expired": true, "live": true, "unknown": false} {
+				revoked, err := store.IsAccessTokenRevoked(id)
+				if err != nil || revoked != want {
+					t.Errorf("IsAccessTokenRevoked(%q), got: %t, %v, want: %t", id, revoked, err, want)
+				}
+			}
+
+			purged, err := store.PurgeRevokedAccessTokens(now)
+			if err != nil || purged != 1 {
+				t.Errorf("PurgeRevokedAccessTokens, got: %d, %v, want: 1", purged, err)
+			}
+			if revoked, _ := store.IsAccessTokenRevoked("live"); !revoked {
+				t.Errorf("IsAccessTokenRevoked after purging, got: false, want the unexpired token kept")
+			}
+
+			store.CreateRefreshToken(user.Id, "refresh-token", now.Add(time.Hour), Client{})
+
+			updated, _ := store.UpdateUserEmailPasswordById(user.Id, "new@example.com", "hash")
+			if updated.TokenVersion != 0 {
+				t.Errorf("TokenVersion after changing the email, got: %d, want: 0", updated.TokenVersion)
+			}
+			if _, _, err := store.GetUserAndRefreshTokenByRefreshToken("refresh-token"); err != nil {
+				t.Errorf("refresh token after changing the email, got: %v, want it kept", err)
+			}
+
+			updated, _ = store.UpdateUserEmailPasswordById(user.Id, "new@example.com", "new-hash")
+			if updated.TokenVersion != 1 {
+				t.Errorf("TokenVersion after changing the password, got: %d, want: 1", updated.TokenVersion)
+			}
+			if _, _, err := store.GetUserAndRefreshTokenByRefreshToken("refresh-token"); err != ErrRefreshTokenDoesNotExist {
+				t.Errorf("refresh token after changing the password, got: %v, want: %v", err, ErrRefreshTokenDoesNotExist)
+			}
+		})
+	}
+
+	// The denylist has to survive a restart.
+	sqliteDB.Close()
+	reopened, err := NewSQLiteDB(sqlitePath, Options{})
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+	defer reopened.Close()
+
+	revoked, err := reopened.IsAccessTokenRevoked("live")
+	if err != nil || !revoked {
+		t.Errorf("IsAccessTokenRevoked after reopening, got: %t, %v, want: true", revoked, err)
+	}
+}
+
+func TestOpenLocking(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := NewDB(db.path, false)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("second writer, got: %v, want: %v", err, ErrDatabaseLocked)
+	}
+
+	_, err = Open(db.path, Options{ReadOnly: true})
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("reader while writer is open, got: %v, want: %v", err, ErrDatabaseLocked)
+	}
+
+	db.CreateChirp("hello", 1)
+	db.Close()
+
+	first, err := Open(db.path, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("error opening first reader: %v", err)
+	}
+	defer first.Close()
+
+	second, err := Open(db.path, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("error opening second reader: %v", err)
+	}
+	defer second.Close()
+
+	chirps, err := second.GetChirps()
+	if err != nil || len(chirps) != 1 {
+		t.Errorf("GetChirps on reader, got: %+v, %v", chirps, err)
+	}
+
+	_, err = second.CreateChirp("hello", 1)
+	if err != ErrReadOnly {
+		t.Errorf("CreateChirp on reader, got: %v, want: %v", err, ErrReadOnly)
+	}
+
+	_, err = NewDB(db.path, false)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("writer while readers are open, got: %v, want: %v", err, ErrDatabaseLocked)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	key := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	db, err := Open(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	db.CreateUser("secret@example.com", "hash")
+	db.Compact()
+	db.CreateUser("logged@example.com", "hash")
+
+	for _, file := range []string{path, db.walPath()} {
+		data, _ := os.ReadFile(file)
+		if bytes.Contains(data, []byte("@example.com")) {
+			t.Errorf("%s holds plaintext emails", file)
+		}
+	}
+	db.Close()
+
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr error
+	}{
+		{name: "no key", key: nil, wantErr: ErrEncryptionKeyMissing},
+		{name: "wrong key", key: newKey, wantErr: ErrWrongEncryptionKey},
+		{name: "right key", key: key, wantErr: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(path, Options{EncryptionKey: tt.key})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Open, got: %v, want: %v", err, tt.wantErr)
+			}
+			if err == nil {
+				db.Close()
+			}
+		})
+	}
+
+	db, err = Open(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	err = db.Rekey(newKey)
+	if err != nil {
+		t.Fatalf("error rekeying database: %v", err)
+	}
+	db.Close()
+
+	_, err = Open(path, Options{EncryptionKey: key})
+	if !errors.Is(err, ErrWrongEncryptionKey) {
+		t.Errorf("Open with old key after rekey, got: %v, want: %v", err, ErrWrongEncryptionKey)
+	}
+
+	db, err = Open(path, Options{EncryptionKey: newKey})
+	if err != nil {
+		t.Fatalf("error opening database with new key: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.GetUserByEmail("logged@example.com")
+	if err != nil {
+		t.Errorf("error reading user after rekey: %v", err)
+	}
+
+	aead, _ := newAEAD(newKey)
+	_, _, err = readDBFile(db.backupPath(), aead, false)
+	if err != nil {
+		t.Errorf("error reading backup with new key after rekey: %v", err)
+	}
+}
+
+func TestEncryptionRejectsPlaintext(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	t.Run("snapshot", func(t *testing.T) {
+		db := newTestDB(t)
+		db.CreateUser("plain@example.com", "hash")
+		path := db.path
+		db.Close()
+
+		_, err := Open(path, Options{EncryptionKey: key})
+		if !errors.Is(err, ErrDatabaseNotEncrypted) {
+			t.Fatalf("Open plaintext with a key, got: %v, want: %v", err, ErrDatabaseNotEncrypted)
+		}
+
+		db, err = Open(path, Options{EncryptionKey: key, AllowPlaintext: true})
+		if err != nil {
+			t.Fatalf("error opening plaintext to encrypt it: %v", err)
+		}
+		err = db.Rekey(key)
+		db.Close()
+		if err != nil {
+			t.Fatalf("error encrypting database: %v", err)
+		}
+
+		db, err = Open(path, Options{EncryptionKey: key})
+		if err != nil {
+			t.Fatalf("error opening encrypted database: %v", err)
+		}
+		defer db.Close()
+
+		_, err = db.GetUserByEmail("plain@example.com")
+		if err != nil {
+			t.Errorf("error reading user after encrypting: %v", err)
+		}
+	})
+
+	t.Run("log line", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database.json")
+		db, err := Open(path, Options{EncryptionKey: key})
+		if err != nil {
+			t.Fatalf("error opening database: %v", err)
+		}
+		db.CreateUser("sealed@example.com", "hash")
+
+		// Stop without compacting, so the sealed line stays in the log, and
+		// slip a plaintext line in front of it.
+		close(db.stop)
+		<-db.done
+		db.wal.Close()
+		releaseLock(db.lock)
+
+		sealed, _ := os.ReadFile(db.walPath())
+		forged := `[{"op":"put_user","user":{"id":2,"email":"forged@example.com"}}]` + "\n"
+		os.WriteFile(db.walPath(), append([]byte(forged), sealed...), 0666)
+
+		reopened, err := Open(path, Options{EncryptionKey: key})
+		if err == nil {
+			reopened.Close()
+		}
+		if !errors.Is(err, ErrDatabaseNotEncrypted) {
+			t.Errorf("Open with a plaintext log line, got: %v, want: %v", err, ErrDatabaseNotEncrypted)
+		}
+	})
+}
+
+func TestBackupRestore(t *testing.T) {
+	db := newTestDB(t)
+
+	user, _ := db.CreateUser("user@example.com", "hash")
+	db.CreateChirp("before backup", user.Id)
+
+	var snapshot bytes.Buffer
+	err := db.Backup(&snapshot)
+	if err != nil {
+		t.Fatalf("error writing backup: %v", err)
+	}
+
+	db.CreateChirp("after backup", user.Id)
+
+	err = db.Restore(strings.NewReader("not a snapshot"))
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Restore with garbage, got: %v, want: %v", err, ErrInvalidSnapshot)
+	}
+
+	err = db.Restore(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatalf("error restoring backup: %v", err)
+	}
+
+	chirps, err := db.GetChirpsByAuthor(user.Id)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "before backup" {
+		t.Errorf("GetChirpsByAuthor after restore, got: %+v, %v", chirps, err)
+	}
+
+	other, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer other.Close()
+
+	err = other.Restore(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatalf("error restoring backup into another database: %v", err)
+	}
+
+	_, err = other.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Errorf("error reading restored user: %v", err)
+	}
+}
+
+func TestRestoreEmptiesLog(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	user, _ := db.CreateUser("user@example.com", "hash")
+
+	var snapshot bytes.Buffer
+	err = db.Backup(&snapshot)
+	if err != nil {
+		t.Fatalf("error writing backup: %v", err)
+	}
+
+	chirp, _ := db.CreateChirp("before restore", user.Id)
+
+	err = db.Restore(&snapshot)
+	if err != nil {
+		t.Fatalf("error restoring backup: %v", err)
+	}
+
+	info, err := os.Stat(db.walPath())
+	if err != nil || info.Size() != 0 {
+		t.Fatalf("log after restore, got: %v, %v, want it empty", info, err)
+	}
+
+	// Crash without compacting, so reopening replays whatever the log holds.
+	close(db.stop)
+	<-db.done
+	db.wal.Close()
+	releaseLock(db.lock)
+
+	reopened, err := NewDB(db.path, false)
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+	defer reopened.Close()
+
+	_, err = reopened.GetChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("chirp from before the restore, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db := newTestDB(t)
+
+	events, unsubscribe := db.Subscribe(10)
+	defer unsubscribe()
+
+	slow, _ := db.Subscribe(1)
+
+	user, _ := db.CreateUser("user@example.com", "hash")
+	db.CreateUser("user@example.com", "hash")
+	chirp, _ := db.CreateChirp("hello", user.Id)
+	db.DeleteChirpById(chirp.Id)
+	db.UpgradeUserToRedByUserId(user.Id)
+
+	want := []EventType{UserCreated, ChirpCreated, ChirpDeleted, UserUpdated}
+	for i, wantType := range want {
+		event := <-events
+		if event.Type != wantType || event.Seq != uint64(i+1) {
+			t.Errorf("Event %d, got: %s (seq %d), want: %s (seq %d)", i, event.Type, event.Seq, wantType, i+1)
+		}
+
+		if event.Type == ChirpDeleted && (event.Chirp == nil || event.Chirp.Body != "hello") {
+			t.Errorf("ChirpDeleted payload, got: %+v", event.Chirp)
+		}
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+
+	if received != 1 {
+		t.Errorf("Events delivered to slow subscriber before it was dropped, got: %d, want: 1", received)
+	}
+}
+
+func TestSubscriberFollowsLargeTransaction(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+			for i := 0; i < 20; i++ {
+				chirp, _ := store.CreateChirp("purged", user.Id)
+				store.DeleteChirpById(chirp.Id)
+			}
+
+			// The purge is one transaction of 20 events, far more than the
+			// buffer holds, but the subscriber keeps reading.
+			events, unsubscribe := store.Subscribe(1)
+			defer unsubscribe()
+
+			received := make(chan int)
+			go func() {
+				count := 0
+				for event := range events {
+					if event.Type == ChirpPurged {
+						count++
+					}
+					if count == 20 {
+						break
+					}
+				}
+				received <- count
+			}()
+
+			purged, err := store.PurgeDeletedChirps(time.Now().Add(time.Minute))
+			if err != nil || purged != 20 {
+				t.Fatalf("PurgeDeletedChirps, got: %d, %v, want: 20", purged, err)
+			}
+
+			if count := <-received; count != 20 {
+				t.Errorf("Events received before being dropped, got: %d, want: 20", count)
+			}
+		})
+	}
+}
+
+func TestEventsArriveInCommitOrder(t *testing.T) {
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	stores := map[string]Store{"json": newTestDB(t), "sqlite": sqliteDB}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, _ := store.CreateUser("user@example.com", "hash")
+
+			events, unsubscribe := store.Subscribe(100)
+			defer unsubscribe()
+			// A subscriber that never reads is dropped without holding up
+			// the others.
+			store.Subscribe(1)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					store.CreateChirp("concurrent", user.Id)
+				}()
+			}
+			wg.Wait()
+
+			var last Event
+			for i := 0; i < 20; i++ {
+				event := <-events
+				if i > 0 && (event.Seq != last.Seq+1 || event.Chirp.Id < last.Chirp.Id) {
+					t.Fatalf("Event after seq %d (chirp %d), got: seq %d (chirp %d), want the next one", last.Seq, last.Chirp.Id, event.Seq, event.Chirp.Id)
+				}
+				last = event
+			}
+		})
+	}
+}
+
+func TestIdsNotReusedAfterDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	first, _ := db.CreateChirp("first", 1)
+	second, _ := db.CreateChirp("second", 1)
+	err = db.DeleteChirpById(second.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	_, err = db.PurgeDeletedChirps(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("error purging chirps: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("error closing database: %v", err)
+	}
+
+	db, err = NewDB(path, false)
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	third, err := db.CreateChirp("third", 1)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	if third.Id <= second.Id || third.Id <= first.Id {
+		t.Errorf("CreateChirp id, got: %d, want greater than %d", third.Id, second.Id)
+	}
+}
+
+func TestSnowflakeGenerator(t *testing.T) {
+	generator := &SnowflakeGenerator{Node: 7}
+
+	last := 0
+	for i := 0; i < 10000; i++ {
+		id := generator.NextID(chirpsSequence, last)
+		if id <= last {
+			t.Fatalf("NextID, got: %d, want greater than %d", id, last)
+		}
+		last = id
+	}
+
+	future := last + 1<<40
+	if id := generator.NextID(chirpsSequence, future); id != future+1 {
+		t.Errorf("NextID behind last, got: %d, want: %d", id, future+1)
+	}
+}
+
+// TestIdsSurviveJSONNumbers switches a database from sequential to snowflake
+// ids and reads both back the way a JSON client does, as float64.
+func TestIdsSurviveJSONNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := Open(path, Options{IDGenerator: SequenceGenerator{}})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	sequential, _ := db.CreateChirp("sequential", 1)
+	db.Close()
+
+	db, err = Open(path, Options{IDGenerator: &SnowflakeGenerator{Node: SnowflakeMaxNode}})
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	snowflakes := []Chirp{}
+	for i := 0; i < 300; i++ {
+		chirp, err := db.CreateChirp("snowflake", 1)
+		if err != nil {
+			t.Fatalf("error creating chirp: %v", err)
+		}
+		snowflakes = append(snowflakes, chirp)
+	}
+
+	for _, chirp := range append([]Chirp{sequential}, snowflakes...) {
+		data, err := json.Marshal(chirp)
+		if err != nil {
+			t.Fatalf("error encoding chirp: %v", err)
+		}
+
+		var decoded struct {
+			Id float64 `json:"id"`
+		}
+		err = json.Unmarshal(data, &decoded)
+		if err != nil {
+			t.Fatalf("error decoding chirp: %v", err)
+		}
+
+		got, err := db.GetChirpById(int(decoded.Id))
+		if err != nil || got.Id != chirp.Id {
+			t.Errorf("GetChirpById of id %d read as %v, got: %d, %v", chirp.Id, decoded.Id, got.Id, err)
+		}
+	}
+}
+
+func TestSoftDeleteChirp(t *testing.T) {
+	db := newTestDB(t)
+
+	kept, _ := db.CreateChirp("kept", 1)
+	chirp, _ := db.CreateChirp("deleted", 1)
+
+	err := db.DeleteChirpById(chirp.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	_, err = db.GetChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("GetChirpById after delete, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+
+	chirps, _ := db.GetChirpsByAuthor(1)
+	if len(chirps) != 1 || chirps[0].Id != kept.Id {
+		t.Errorf("GetChirpsByAuthor after delete, got: %+v, want only chirp %d", chirps, kept.Id)
+	}
+
+	deleted, err := db.GetDeletedChirpById(chirp.Id)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Fatalf("GetDeletedChirpById, got: %+v, %v", deleted, err)
+	}
+
+	restored, err := db.RestoreChirpById(chirp.Id)
+	if err != nil || restored.DeletedAt != nil {
+		t.Fatalf("RestoreChirpById, got: %+v, %v", restored, err)
+	}
+
+	_, err = db.RestoreChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("RestoreChirpById on a live chirp, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+
+	db.DeleteChirpById(chirp.Id)
+
+	purged, err := db.PurgeDeletedChirps(time.Now().Add(-time.Minute))
+	if err != nil || purged != 0 {
+		t.Errorf("PurgeDeletedChirps before retention, got: %d, %v, want: 0", purged, err)
+	}
+
+	purged, err = db.PurgeDeletedChirps(time.Now().Add(time.Minute))
+	if err != nil || purged != 1 {
+		t.Errorf("PurgeDeletedChirps after retention, got: %d, %v, want: 1", purged, err)
+	}
+
+	_, err = db.GetDeletedChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("GetDeletedChirpById after purge, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+}
+
+func TestApply(t *testing.T) {
+	source := newTestDB(t)
+	events, unsubscribe := source.Subscribe(100)
+
+	user, _ := source.CreateUser("user@example.com", "hash")
+	kept, _ := source.CreateChirp("kept", user.Id)
+	purged, _ := source.CreateChirp("purged", user.Id)
+	source.DeleteChirpById(purged.Id)
+	source.PurgeDeletedChirps(time.Now().Add(time.Minute))
+	source.UpdateUserEmailPasswordById(user.Id, "new@example.com", "new-hash")
+	source.CreateRefreshToken(user.Id, "revoked", time.Now().Add(time.Hour), Client{})
+	source.DeleteRefreshToken("revoked")
+	unsubscribe()
+
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+
+	targets := []struct {
+		name  string
+		store Store
+	}{
+		{name: "json", store: newTestDB(t)},
+		{name: "sqlite", store: sqliteDB},
+	}
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+
+	for _, tt := range targets {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, event := range received {
+				err := tt.store.Apply(event)
+				if err != nil {
+					t.Fatalf("error applying %s: %v", event.Type, err)
+				}
+			}
+
+			chirps, _ := tt.store.GetChirps()
+			if len(chirps) != 1 || chirps[0].Id != kept.Id {
+				t.Errorf("GetChirps, got: %+v, want only chirp %d", chirps, kept.Id)
+			}
+
+			got, err := tt.store.GetUserByEmail("new@example.com")
+			if err != nil || got.PasswordHash != "new-hash" {
+				t.Errorf("GetUserByEmail, got: %+v, %v", got, err)
+			}
+
+			tokens, _ := tt.store.GetRefreshTokensByUser(user.Id)
+			if len(tokens) != 0 {
+				t.Errorf("GetRefreshTokensByUser, got: %+v, want none", tokens)
+			}
+
+			err = tt.store.Apply(Event{Type: DatabaseRestored})
+			if !errors.Is(err, ErrInvalidEvent) {
+				t.Errorf("Apply %s, got: %v, want: %v", DatabaseRestored, err, ErrInvalidEvent)
+			}
+		})
+	}
+}
+
+func TestRefreshTokensStoredHashed(t *testing.T) {
+	openers := map[string]func(dir string) (Store, error){
+		"json": func(dir string) (Store, error) { return NewDB(filepath.Join(dir, "database.json"), false) },
+		"sqlite": func(dir string) (Store, error) {
+			return NewSQLiteDB(filepath.Join(dir, "database.db"), Options{})
+		},
+	}
+
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := open(dir)
+			if err != nil {
+				t.Fatalf("error opening database: %v", err)
+			}
+
+			user, _ := store.CreateUser("user@example.com", "hash")
+			_, err = store.CreateRefreshToken(user.Id, "raw-refresh-token", time.Now().UTC().Add(time.Hour), Client{})
+			if err != nil {
+				t.Fatalf("error creating refresh token: %v", err)
+			}
+
+			_, refreshToken, err := store.GetUserAndRefreshTokenByRefreshToken("raw-refresh-token")
+			if err != nil || refreshToken.TokenHash != hashRefreshToken("raw-refresh-token") {
+				t.Errorf("GetUserAndRefreshTokenByRefreshToken, got: %+v, %v", refreshToken, err)
+			}
+
+			err = store.Close()
+			if err != nil {
+				t.Fatalf("error closing database: %v", err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatalf("error reading %s: %v", file, err)
+				}
+				if bytes.Contains(data, []byte("raw-refresh-token")) {
+					t.Errorf("%s contains the raw refresh token", filepath.Base(file))
+				}
+			}
+		})
+	}
+}
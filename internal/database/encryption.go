@@ -0,0 +1,141 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Encrypted files and log lines start with encryptionMagic, followed by the
+// AES-GCM nonce and the sealed data. Anything else is plaintext, which is
+// rejected once a key is given: a plaintext file slipped in next to an
+// encrypted database would otherwise be read as if it were trusted. An
+// existing database is encrypted with Rekey, which opens it with
+// Options.AllowPlaintext.
+var encryptionMagic = []byte("CHIRPYENC1")
+
+var ErrEncryptionKeyMissing = errors.New("Database is encrypted and no encryption key was given")
+var ErrWrongEncryptionKey = errors.New("Database encryption key is wrong")
+var ErrDatabaseNotEncrypted = errors.New("Database is not encrypted but an encryption key was given")
+
+// ParseEncryptionKey decodes a base64-encoded 32-byte AES-256 key.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("problem decoding encryption key, %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("problem creating cipher, %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	if aead == nil {
+		return plaintext, nil
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("problem generating nonce, %v", err)
+	}
+
+	sealed := append([]byte{}, encryptionMagic...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, encryptionMagic), nil
+}
+
+func unseal(aead cipher.AEAD, data []byte, allowPlaintext bool) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptionMagic) {
+		if aead != nil && !allowPlaintext {
+			return nil, ErrDatabaseNotEncrypted
+		}
+		return data, nil
+	}
+
+	if aead == nil {
+		return nil, ErrEncryptionKeyMissing
+	}
+
+	data = data[len(encryptionMagic):]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrWrongEncryptionKey
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], encryptionMagic)
+	if err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+
+	return plaintext, nil
+}
+
+func isKeyError(err error) bool {
+	return errors.Is(err, ErrEncryptionKeyMissing) || errors.Is(err, ErrWrongEncryptionKey) || errors.Is(err, ErrDatabaseNotEncrypted)
+}
+
+// Rekey rewrites the snapshot under newKey. An empty newKey stores the
+// database in plaintext. Snapshots written by Backup keep the key they were
+// written with.
+//
+// The log is compacted under the old key first, so the only file left to
+// rekey is the snapshot. Its backup is replaced before the snapshot itself:
+// until the snapshot is renamed into place the database opens with the old
+// key, and afterwards both files use the new one.
+func (db *DB) Rekey(newKey []byte) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	aead, err := newAEAD(newKey)
+	if err != nil {
+		return err
+	}
+
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err = db.compact()
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeDB(db.data, aead)
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	err = replaceFile(db.backupPath(), data)
+	if err == nil {
+		err = replaceFile(db.path, data)
+	}
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	db.aead = aead
+	return nil
+}
@@ -0,0 +1,218 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	ChirpCreated        EventType = "chirp.created"
+	ChirpUpdated        EventType = "chirp.updated"
+	ChirpDeleted        EventType = "chirp.deleted"
+	ChirpRestored       EventType = "chirp.restored"
+	ChirpPurged         EventType = "chirp.purged"
+	UserCreated         EventType = "user.created"
+	UserUpdated         EventType = "user.updated"
+	RefreshTokenCreated EventType = "refresh_token.created"
+	RefreshTokenUpdated EventType = "refresh_token.updated"
+	RefreshTokenRevoked EventType = "refresh_token.revoked"
+	AccessTokenRevoked  EventType = "access_token.revoked"
+	AccessTokenPurged   EventType = "access_token.purged"
+	// DatabaseRestored means the whole database was replaced; subscribers
+	// holding derived state must rebuild it.
+	DatabaseRestored EventType = "database.restored"
+)
+
+type Event struct {
+	Seq          uint64        `json:"seq"`
+	Type         EventType     `json:"type"`
+	Time         time.Time     `json:"time"`
+	Chirp        *Chirp        `json:"chirp,omitempty"`
+	User         *User         `json:"user,omitempty"`
+	RefreshToken *RefreshToken `json:"refresh_token,omitempty"`
+
+	RevokedAccessToken *RevokedAccessToken `json:"revoked_access_token,omitempty"`
+}
+
+// feed fans events out to in-process subscribers. Stores queue a
+// transaction's events while they still hold the lock that orders their
+// commits, and deliver them with flush once they let go of it, so events
+// arrive in commit order without a slow subscriber holding up other
+// readers and writers. A subscriber whose buffer fills up gets up to
+// publishTimeout to make room, so one reading along can follow a transaction
+// larger than its buffer, such as a purge. A subscriber still full after that
+// is dropped and its channel closed, and it can resubscribe and use Seq to
+// notice what it missed.
+type feed struct {
+	// mu guards seq and pending, and is never held while delivering.
+	mu      sync.Mutex
+	seq     uint64
+	pending []Event
+
+	// deliverMu guards subscribers and is held while delivering, so one
+	// flush at a time sends events, in the order they were queued.
+	deliverMu   sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+const defaultSubscriberBuffer = 64
+
+// publishTimeout bounds how long one flush waits on full subscribers, so a
+// stuck subscriber holds up delivery once before it is dropped.
+const publishTimeout = 100 * time.Millisecond
+
+// Subscribe returns a channel of change events and a function that ends the
+// subscription. buffer is how many events may queue before the subscriber
+// is considered too slow and dropped.
+func (f *feed) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = defaultSubscriberBuffer
+	}
+
+	ch := make(chan Event, buffer)
+
+	f.deliverMu.Lock()
+	if f.subscribers == nil {
+		f.subscribers = map[chan Event]struct{}{}
+	}
+	f.subscribers[ch] = struct{}{}
+	f.deliverMu.Unlock()
+
+	return ch, func() {
+		f.deliverMu.Lock()
+		defer f.deliverMu.Unlock()
+
+		if _, ok := f.subscribers[ch]; ok {
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// queue numbers events and holds them for the next flush. Callers queue
+// while holding the lock that orders their commits.
+func (f *feed) queue(events ...Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, event := range events {
+		f.seq++
+		event.Seq = f.seq
+		event.Time = now
+		f.pending = append(f.pending, event)
+	}
+}
+
+// flush delivers every queued event. Callers flush after releasing their
+// own locks; whichever flush runs first delivers the events queued by the
+// others too.
+func (f *feed) flush() {
+	f.deliverMu.Lock()
+	defer f.deliverMu.Unlock()
+
+	f.mu.Lock()
+	events := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(publishTimeout)
+	for ch := range f.subscribers {
+		if !send(ch, events, deadline) {
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// send delivers events to ch, waiting until deadline for room once its
+// buffer is full, and reports whether every event was delivered.
+func send(ch chan Event, events []Event, deadline time.Time) bool {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for _, event := range events {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(time.Until(deadline))
+		}
+
+		select {
+		case ch <- event:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
+
+func (f *feed) closeSubscribers() {
+	f.deliverMu.Lock()
+	defer f.deliverMu.Unlock()
+
+	for ch := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventsFor turns the entries of a committed transaction into events, using
+// the undo entries to tell creations from updates.
+func eventsFor(tx *txLog) []Event {
+	events := make([]Event, 0, len(tx.entries))
+
+	for i, entry := range tx.entries {
+		undo := tx.undo[i]
+
+		switch entry.Op {
+		case opPutChirp:
+			eventType := ChirpUpdated
+			switch {
+			case undo.Op == opDeleteChirp:
+				eventType = ChirpCreated
+			case entry.Chirp.DeletedAt != nil && undo.Chirp.DeletedAt == nil:
+				eventType = ChirpDeleted
+			case entry.Chirp.DeletedAt == nil && undo.Chirp.DeletedAt != nil:
+				eventType = ChirpRestored
+			}
+			events = append(events, Event{Type: eventType, Chirp: entry.Chirp})
+		case opDeleteChirp:
+			events = append(events, Event{Type: ChirpPurged, Chirp: undo.Chirp})
+		case opPutUser:
+			eventType := UserUpdated
+			if undo.Op == opDeleteUser {
+				eventType = UserCreated
+			}
+			events = append(events, Event{Type: eventType, User: entry.User})
+		case opPutRefreshToken:
+			eventType := RefreshTokenUpdated
+			if undo.Op == opDeleteRefreshToken {
+				eventType = RefreshTokenCreated
+			}
+			events = append(events, Event{Type: eventType, RefreshToken: entry.RefreshToken})
+		case opDeleteRefreshToken:
+			events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: undo.RefreshToken})
+		case opPutRevokedAccessToken:
+			events = append(events, Event{Type: AccessTokenRevoked, RevokedAccessToken: entry.RevokedAccessToken})
+		case opDeleteRevokedAccessToken:
+			events = append(events, Event{Type: AccessTokenPurged, RevokedAccessToken: undo.RevokedAccessToken})
+		}
+	}
+
+	return events
+}
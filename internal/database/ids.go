@@ -0,0 +1,100 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	chirpsSequence = "chirps"
+	usersSequence  = "users"
+)
+
+// IDGenerator issues ids for new records. last is the highest id ever issued
+// for kind, including ids of deleted records, and the result must exceed it
+// so ids are never reused.
+type IDGenerator interface {
+	NextID(kind string, last int) int
+}
+
+// SequenceGenerator issues 1, 2, 3, ... per kind.
+type SequenceGenerator struct{}
+
+func (SequenceGenerator) NextID(kind string, last int) int {
+	return last + 1
+}
+
+// SnowflakeGenerator issues time-ordered 53-bit ids: 41 bits of milliseconds
+// since snowflakeEpoch, then a 4-bit node id, then an 8-bit per-millisecond
+// counter. Nodes sharing a database need distinct node ids. The ids are
+// still integers, so they sort after and alongside existing sequential ids,
+// and 53 bits is as much as a float64 holds exactly, so JSON and JavaScript
+// clients read them without rounding.
+type SnowflakeGenerator struct {
+	Node int
+
+	mu       sync.Mutex
+	lastTime int64
+	counter  int64
+}
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	snowflakeNodeBits    = 4
+	snowflakeCounterBits = 8
+
+	// SnowflakeMaxNode is the largest node id a SnowflakeGenerator embeds.
+	SnowflakeMaxNode = 1<<snowflakeNodeBits - 1
+)
+
+func (g *SnowflakeGenerator) NextID(kind string, last int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Since(snowflakeEpoch).Milliseconds()
+	if now == g.lastTime {
+		g.counter = (g.counter + 1) & (1<<snowflakeCounterBits - 1)
+		if g.counter == 0 {
+			for now <= g.lastTime {
+				now = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.counter = 0
+	}
+	g.lastTime = now
+
+	node := int64(g.Node) & SnowflakeMaxNode
+	id := int(now<<(snowflakeNodeBits+snowflakeCounterBits) | node<<snowflakeCounterBits | g.counter)
+
+	// A clock that moved backwards must not produce an id already handed out.
+	if id <= last {
+		return last + 1
+	}
+	return id
+}
+
+func (dbStructure *DBStructure) nextId(generator IDGenerator, kind string) int {
+	return generator.NextID(kind, dbStructure.Sequences[kind])
+}
+
+func (dbStructure *DBStructure) advanceSequence(kind string, id int) {
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]int{}
+	}
+	if id > dbStructure.Sequences[kind] {
+		dbStructure.Sequences[kind] = id
+	}
+}
+
+// syncSequences raises each sequence to at least the largest stored id, so a
+// hand-edited or restored file can't lead to an id being issued twice.
+func (dbStructure *DBStructure) syncSequences() {
+	for id := range dbStructure.Chirps {
+		dbStructure.advanceSequence(chirpsSequence, id)
+	}
+	for id := range dbStructure.Users {
+		dbStructure.advanceSequence(usersSequence, id)
+	}
+}
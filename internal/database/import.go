@@ -0,0 +1,63 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrIdTaken = errors.New("Id is already taken")
+
+// Import adds users and chirps in one transaction, so a rejected import
+// changes nothing. Records keep their timestamps.
+//
+// Without remapIds records keep their ids, and an id the store has already
+// issued is rejected with ErrIdTaken. That covers ids held by soft-deleted
+// chirps and ids of records since purged, which clients may still refer to,
+// so importing keeping ids only suits a store that hasn't issued them yet,
+// such as a new one. Chirps may belong to users in the import or already in
+// the store. With remapIds every record gets a
+// fresh id, and chirps must belong to a user in the import, whose new id
+// they follow.
+func (db *DB) Import(users []User, chirps []Chirp, remapIds bool) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		newUserIds := map[int]int{}
+		lastUserId := dbStructure.Sequences[usersSequence]
+		lastChirpId := dbStructure.Sequences[chirpsSequence]
+
+		for _, user := range users {
+			if _, ok := dbStructure.idx.userIdByEmail[user.Email]; ok {
+				return fmt.Errorf("%w: %s", ErrUserAlreadyExists, user.Email)
+			}
+
+			if remapIds {
+				newUserIds[user.Id] = dbStructure.nextId(db.opts.IDGenerator, usersSequence)
+				user.Id = newUserIds[user.Id]
+			} else if _, ok := dbStructure.Users[user.Id]; ok || user.Id <= lastUserId {
+				return fmt.Errorf("%w: user %d", ErrIdTaken, user.Id)
+			}
+
+			dbStructure.PutUser(user)
+		}
+
+		for _, chirp := range chirps {
+			if remapIds {
+				authorId, ok := newUserIds[chirp.AuthorId]
+				if !ok {
+					return fmt.Errorf("%w: author %d of chirp %d", ErrUserDoesNotExist, chirp.AuthorId, chirp.Id)
+				}
+				chirp.AuthorId = authorId
+				chirp.Id = dbStructure.nextId(db.opts.IDGenerator, chirpsSequence)
+			} else {
+				if _, ok := dbStructure.Users[chirp.AuthorId]; !ok {
+					return fmt.Errorf("%w: author %d of chirp %d", ErrUserDoesNotExist, chirp.AuthorId, chirp.Id)
+				}
+				if _, ok := dbStructure.Chirps[chirp.Id]; ok || chirp.Id <= lastChirpId {
+					return fmt.Errorf("%w: chirp %d", ErrIdTaken, chirp.Id)
+				}
+			}
+
+			dbStructure.PutChirp(chirp)
+		}
+		return nil
+	})
+}
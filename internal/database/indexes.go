@@ -0,0 +1,162 @@
+package database
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// indexes are lookups derived from DBStructure. They are never stored; Open
+// rebuilds them and apply keeps them in step with every change.
+type indexes struct {
+	userIdByEmail map[string]int
+	userIds       []int
+	// chirpIds and chirpIdsByAuthor are kept sorted so pages of chirps can
+	// be read in id order without sorting every chirp.
+	chirpIds            []int
+	chirpIdsByAuthor    map[int][]int
+	chirpsByCreatedAt   []chirpKey
+	refreshTokensByUser map[int]map[string]struct{}
+}
+
+// chirpKey places a chirp in creation order, with ties broken by id.
+type chirpKey struct {
+	createdAt time.Time
+	id        int
+}
+
+func keyOf(chirp Chirp) chirpKey {
+	return chirpKey{createdAt: chirp.CreatedAt, id: chirp.Id}
+}
+
+func compareChirpKeys(a, b chirpKey) int {
+	if c := a.createdAt.Compare(b.createdAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+func (dbStructure *DBStructure) buildIndexes() {
+	dbStructure.idx = &indexes{
+		userIdByEmail:       make(map[string]int, len(dbStructure.Users)),
+		userIds:             make([]int, 0, len(dbStructure.Users)),
+		chirpIds:            make([]int, 0, len(dbStructure.Chirps)),
+		chirpIdsByAuthor:    map[int][]int{},
+		chirpsByCreatedAt:   make([]chirpKey, 0, len(dbStructure.Chirps)),
+		refreshTokensByUser: map[int]map[string]struct{}{},
+	}
+
+	for _, user := range dbStructure.Users {
+		dbStructure.idx.userIdByEmail[user.Email] = user.Id
+		dbStructure.idx.userIds = append(dbStructure.idx.userIds, user.Id)
+	}
+	slices.Sort(dbStructure.idx.userIds)
+	for _, chirp := range dbStructure.Chirps {
+		dbStructure.idx.chirpIds = append(dbStructure.idx.chirpIds, chirp.Id)
+		dbStructure.idx.chirpIdsByAuthor[chirp.AuthorId] = append(dbStructure.idx.chirpIdsByAuthor[chirp.AuthorId], chirp.Id)
+		dbStructure.idx.chirpsByCreatedAt = append(dbStructure.idx.chirpsByCreatedAt, keyOf(chirp))
+	}
+	slices.Sort(dbStructure.idx.chirpIds)
+	slices.SortFunc(dbStructure.idx.chirpsByCreatedAt, compareChirpKeys)
+	for _, chirpIds := range dbStructure.idx.chirpIdsByAuthor {
+		slices.Sort(chirpIds)
+	}
+	for _, refreshToken := range dbStructure.RefreshTokens {
+		addToSet(dbStructure.idx.refreshTokensByUser, refreshToken.UserId, refreshToken.TokenHash)
+	}
+}
+
+func (idx *indexes) putChirp(prev *Chirp, chirp Chirp) {
+	if prev != nil {
+		removeFromSorted(idx.chirpIdsByAuthor, prev.AuthorId, prev.Id)
+		idx.chirpsByCreatedAt = removeKey(idx.chirpsByCreatedAt, keyOf(*prev))
+	}
+	idx.chirpIds = insertSorted(idx.chirpIds, chirp.Id)
+	idx.chirpIdsByAuthor[chirp.AuthorId] = insertSorted(idx.chirpIdsByAuthor[chirp.AuthorId], chirp.Id)
+	if i, ok := slices.BinarySearchFunc(idx.chirpsByCreatedAt, keyOf(chirp), compareChirpKeys); !ok {
+		idx.chirpsByCreatedAt = slices.Insert(idx.chirpsByCreatedAt, i, keyOf(chirp))
+	}
+}
+
+func (idx *indexes) deleteChirp(chirp Chirp) {
+	if i, ok := slices.BinarySearch(idx.chirpIds, chirp.Id); ok {
+		idx.chirpIds = slices.Delete(idx.chirpIds, i, i+1)
+	}
+	removeFromSorted(idx.chirpIdsByAuthor, chirp.AuthorId, chirp.Id)
+	idx.chirpsByCreatedAt = removeKey(idx.chirpsByCreatedAt, keyOf(chirp))
+}
+
+func (idx *indexes) putUser(prev *User, user User) {
+	if prev != nil && idx.userIdByEmail[prev.Email] == prev.Id {
+		delete(idx.userIdByEmail, prev.Email)
+	}
+	idx.userIdByEmail[user.Email] = user.Id
+	idx.userIds = insertSorted(idx.userIds, user.Id)
+}
+
+func (idx *indexes) deleteUser(user User) {
+	if idx.userIdByEmail[user.Email] == user.Id {
+		delete(idx.userIdByEmail, user.Email)
+	}
+	if i, ok := slices.BinarySearch(idx.userIds, user.Id); ok {
+		idx.userIds = slices.Delete(idx.userIds, i, i+1)
+	}
+}
+
+func (idx *indexes) putRefreshToken(prev *RefreshToken, refreshToken RefreshToken) {
+	if prev != nil {
+		removeFromSet(idx.refreshTokensByUser, prev.UserId, prev.TokenHash)
+	}
+	addToSet(idx.refreshTokensByUser, refreshToken.UserId, refreshToken.TokenHash)
+}
+
+func (idx *indexes) deleteRefreshToken(refreshToken RefreshToken) {
+	removeFromSet(idx.refreshTokensByUser, refreshToken.UserId, refreshToken.TokenHash)
+}
+
+func addToSet[K, V comparable](sets map[K]map[V]struct{}, key K, value V) {
+	set, ok := sets[key]
+	if !ok {
+		set = map[V]struct{}{}
+		sets[key] = set
+	}
+	set[value] = struct{}{}
+}
+
+func insertSorted(ids []int, id int) []int {
+	i, ok := slices.BinarySearch(ids, id)
+	if ok {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+func removeFromSorted[K comparable](lists map[K][]int, key K, id int) {
+	i, ok := slices.BinarySearch(lists[key], id)
+	if !ok {
+		return
+	}
+	lists[key] = slices.Delete(lists[key], i, i+1)
+	if len(lists[key]) == 0 {
+		delete(lists, key)
+	}
+}
+
+func removeKey(keys []chirpKey, key chirpKey) []chirpKey {
+	i, ok := slices.BinarySearchFunc(keys, key, compareChirpKeys)
+	if !ok {
+		return keys
+	}
+	return slices.Delete(keys, i, i+1)
+}
+
+func removeFromSet[K, V comparable](sets map[K]map[V]struct{}, key K, value V) {
+	set, ok := sets[key]
+	if !ok {
+		return
+	}
+	delete(set, value)
+	if len(set) == 0 {
+		delete(sets, key)
+	}
+}
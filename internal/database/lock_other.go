@@ -0,0 +1,22 @@
+//go:build !unix
+
+package database
+
+import (
+	"fmt"
+	"os"
+)
+
+// Advisory locks are only implemented on unix; elsewhere the lock file is
+// created but nothing stops a second process from opening the database.
+func acquireLock(path string, shared bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+	return file, nil
+}
+
+func releaseLock(file *os.File) error {
+	return file.Close()
+}
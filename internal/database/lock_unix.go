@@ -0,0 +1,40 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func acquireLock(path string, shared bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, path)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("problem locking %s, %v", path, err)
+	}
+
+	return file, nil
+}
+
+func releaseLock(file *os.File) error {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return file.Close()
+}
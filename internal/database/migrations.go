@@ -0,0 +1,319 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A migration upgrades the decoded JSON document of a database file from
+// version-1 to version. Migrations work on the raw document rather than on
+// DBStructure so they keep working after the Go types move on.
+type migration struct {
+	version int
+	name    string
+	up      func(doc map[string]any) error
+}
+
+var migrations = []migration{
+	{version: 1, name: "add schema_version and missing collections", up: migrateEnsureCollections},
+	{version: 2, name: "add id sequences", up: migrateAddSequences},
+	{version: 3, name: "backfill created_at and updated_at", up: migrateBackfillTimestamps},
+	{version: 4, name: "give refresh tokens a family", up: migrateRefreshTokenFamilies},
+	{version: 5, name: "hash refresh tokens", up: migrateHashRefreshTokens},
+	{version: 6, name: "backfill refresh token created_at and last_used_at", up: migrateBackfillRefreshTokenTimestamps},
+	{version: 7, name: "add revoked_access_tokens", up: migrateAddRevokedAccessTokens},
+}
+
+var ErrSchemaTooNew = errors.New("Database schema is newer than this binary supports")
+
+type MigrationStatus struct {
+	Version int
+	Latest  int
+	Pending []string
+}
+
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func SchemaStatus(path string, encryptionKey []byte) (MigrationStatus, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return MigrationStatus{}, fmt.Errorf("problem opening %s, %w", path, err)
+	}
+
+	aead, err := newAEAD(encryptionKey)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	data, err = unseal(aead, data, false)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	status := MigrationStatus{
+		Version: documentVersion(doc),
+		Latest:  LatestSchemaVersion(),
+	}
+
+	for _, m := range migrations {
+		if m.version > status.Version {
+			status.Pending = append(status.Pending, fmt.Sprintf("%d: %s", m.version, m.name))
+		}
+	}
+
+	return status, nil
+}
+
+// migrateDocument decodes a database file, runs every pending migration and
+// returns the result along with the version the file was stored at.
+func migrateDocument(data []byte) (DBStructure, int, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return DBStructure{}, 0, err
+	}
+
+	from := documentVersion(doc)
+	if from > LatestSchemaVersion() {
+		return DBStructure{}, 0, fmt.Errorf("%w: version %d, latest known %d", ErrSchemaTooNew, from, LatestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+
+		err = m.up(doc)
+		if err != nil {
+			return DBStructure{}, 0, fmt.Errorf("problem running migration %d (%s), %v", m.version, m.name, err)
+		}
+		doc["schema_version"] = m.version
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return DBStructure{}, 0, fmt.Errorf("problem encoding migrated db, %v", err)
+	}
+
+	var dbStructure DBStructure
+	err = json.Unmarshal(migrated, &dbStructure)
+	if err != nil {
+		return DBStructure{}, 0, fmt.Errorf("problem parsing db, %v", err)
+	}
+
+	return dbStructure, from, nil
+}
+
+func decodeDocument(data []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc map[string]any
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing db, %v", err)
+	}
+
+	if doc == nil {
+		return nil, fmt.Errorf("problem parsing db, not a JSON object")
+	}
+
+	return doc, nil
+}
+
+func documentVersion(doc map[string]any) int {
+	version, ok := doc["schema_version"].(json.Number)
+	if !ok {
+		return 0
+	}
+
+	v, err := version.Int64()
+	if err != nil {
+		return 0
+	}
+
+	return int(v)
+}
+
+func documentCollection(doc map[string]any, name string) (map[string]any, error) {
+	value, ok := doc[name]
+	if !ok || value == nil {
+		collection := map[string]any{}
+		doc[name] = collection
+		return collection, nil
+	}
+
+	collection, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", name)
+	}
+
+	return collection, nil
+}
+
+func migrateEnsureCollections(doc map[string]any) error {
+	for _, name := range []string{"chirps", "users", "refresh_tokens"} {
+		_, err := documentCollection(doc, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddSequences(doc map[string]any) error {
+	sequences, err := documentCollection(doc, "sequences")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"chirps", "users"} {
+		collection, err := documentCollection(doc, name)
+		if err != nil {
+			return err
+		}
+
+		last := 0
+		for key := range collection {
+			id, err := strconv.Atoi(key)
+			if err != nil {
+				return fmt.Errorf("%s has non-numeric id %q", name, key)
+			}
+			if id > last {
+				last = id
+			}
+		}
+		sequences[name] = last
+	}
+
+	return nil
+}
+
+// Records written before timestamps existed have no creation time to
+// recover, so they take the time of the migration.
+func migrateBackfillTimestamps(doc map[string]any) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	for _, name := range []string{"chirps", "users"} {
+		collection, err := documentCollection(doc, name)
+		if err != nil {
+			return err
+		}
+
+		for key, value := range collection {
+			record, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s %s is not an object", name, key)
+			}
+
+			for _, field := range []string{"created_at", "updated_at"} {
+				if _, ok := record[field]; !ok {
+					record[field] = now
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Tokens issued before rotation each start a family of their own.
+func migrateRefreshTokenFamilies(doc map[string]any) error {
+	refreshTokens, err := documentCollection(doc, "refresh_tokens")
+	if err != nil {
+		return err
+	}
+
+	for key, value := range refreshTokens {
+		record, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh_tokens %s is not an object", key)
+		}
+
+		if _, ok := record["family_id"]; ok {
+			continue
+		}
+
+		familyId, err := newFamilyId()
+		if err != nil {
+			return err
+		}
+		record["family_id"] = familyId
+	}
+
+	return nil
+}
+
+// Refresh tokens used to be stored as issued. Storing their digests instead
+// keeps them working, as lookups hash the presented token.
+func migrateHashRefreshTokens(doc map[string]any) error {
+	refreshTokens, err := documentCollection(doc, "refresh_tokens")
+	if err != nil {
+		return err
+	}
+
+	hashed := make(map[string]any, len(refreshTokens))
+	for key, value := range refreshTokens {
+		record, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh_tokens %s is not an object", key)
+		}
+
+		if _, ok := record["token_hash"]; ok {
+			hashed[key] = record
+			continue
+		}
+
+		tokenHash := hashRefreshToken(key)
+		delete(record, "token")
+		record["token_hash"] = tokenHash
+		hashed[tokenHash] = record
+	}
+
+	doc["refresh_tokens"] = hashed
+	return nil
+}
+
+// Sessions from before refresh tokens were timestamped are dated to the
+// migration, like other records that predate timestamps.
+func migrateBackfillRefreshTokenTimestamps(doc map[string]any) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	refreshTokens, err := documentCollection(doc, "refresh_tokens")
+	if err != nil {
+		return err
+	}
+
+	for key, value := range refreshTokens {
+		record, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh_tokens %s is not an object", key)
+		}
+
+		for _, field := range []string{"created_at", "last_used_at"} {
+			if _, ok := record[field]; !ok {
+				record[field] = now
+			}
+		}
+	}
+
+	return nil
+}
+
+// Users default to token version 0, which decoding fills in, so only the
+// denylist needs adding.
+func migrateAddRevokedAccessTokens(doc map[string]any) error {
+	_, err := documentCollection(doc, "revoked_access_tokens")
+	return err
+}
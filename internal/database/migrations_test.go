@@ -0,0 +1,101 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateHistoricalVersions(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "v*.json"))
+	if err != nil {
+		t.Fatalf("error listing fixtures: %v", err)
+	}
+
+	if len(fixtures) != LatestSchemaVersion()+1 {
+		t.Fatalf("Fixtures, got: %d, want one per schema version: %d", len(fixtures), LatestSchemaVersion()+1)
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			data, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatalf("error reading fixture: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "database.json")
+			err = os.WriteFile(path, data, 0666)
+			if err != nil {
+				t.Fatalf("error writing fixture: %v", err)
+			}
+
+			db, err := NewDB(path, false)
+			if err != nil {
+				t.Fatalf("error opening database: %v", err)
+			}
+
+			user, err := db.GetUserByEmail("user@example.com")
+			if err != nil || !user.IsChirpyRed {
+				t.Errorf("GetUserByEmail, got: %+v, %v", user, err)
+			}
+
+			chirp, err := db.GetChirpById(1)
+			if err != nil {
+				t.Errorf("error reading chirp: %v", err)
+			}
+
+			if chirp.CreatedAt.IsZero() || chirp.UpdatedAt.IsZero() || user.CreatedAt.IsZero() {
+				t.Errorf("timestamps, got chirp: %+v, user: %+v, want them backfilled", chirp, user)
+			}
+
+			if bytes.Contains(data, []byte("refresh_tokens")) {
+				_, refreshToken, err := db.GetUserAndRefreshTokenByRefreshToken("abc123")
+				if err != nil || refreshToken.CreatedAt.IsZero() || refreshToken.LastUsedAt.IsZero() {
+					t.Errorf("GetUserAndRefreshTokenByRefreshToken, got: %+v, %v, want the token from before migrating, timestamped", refreshToken, err)
+				}
+			}
+
+			if bytes.Contains(data, []byte("revoked_access_tokens")) {
+				revoked, err := db.IsAccessTokenRevoked("0123456789abcdef0123456789abcdef")
+				if err != nil || !revoked || user.TokenVersion != 2 {
+					t.Errorf("revoked access tokens, got: %t, %v, token version: %d, want them kept", revoked, err, user.TokenVersion)
+				}
+			}
+
+			_, err = db.CreateRefreshToken(user.Id, "new-token", time.Now().UTC().Add(time.Hour), Client{})
+			if err != nil {
+				t.Errorf("error creating refresh token: %v", err)
+			}
+
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("error closing database: %v", err)
+			}
+
+			status, err := SchemaStatus(path, nil)
+			if err != nil {
+				t.Fatalf("error reading schema status: %v", err)
+			}
+
+			if status.Version != LatestSchemaVersion() || len(status.Pending) != 0 {
+				t.Errorf("SchemaStatus, got: %+v, want version %d with nothing pending", status, LatestSchemaVersion())
+			}
+		})
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{"schema_version":9999,"chirps":{},"users":{},"refresh_tokens":{}}`), 0666)
+	if err != nil {
+		t.Fatalf("error writing database: %v", err)
+	}
+
+	_, err = NewDB(path, false)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("NewDB, got: nil error, want: %v", ErrSchemaTooNew)
+	}
+}
@@ -1,70 +1,331 @@
 package database
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 )
 
 type RefreshToken struct {
-	UserId    int       `json:"user_id"`
-	Token     string    `json:"token"`
+	UserId int `json:"user_id"`
+	// TokenHash is the SHA-256 digest of the token. The token itself is
+	// never stored, so reading the database doesn't let anyone use it.
+	TokenHash string `json:"token_hash"`
+	// FamilyId links every token issued by rotation from the same login.
+	FamilyId  string    `json:"family_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// RotatedAt marks a token already exchanged for a newer one. It is kept
+	// so that using it again can be recognised as theft.
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	// CreatedAt is when the family's first token was issued, and is carried
+	// over by rotation. LastUsedAt is when this token was issued.
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// UserAgent and IP describe the client the token was issued to.
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
 }
 
-var ErrRefreshTokenDoesNotExist = errors.New("Refresh token doesn't exist")
+// IsSession reports whether the token is the current one of a live
+// session: neither rotated nor expired. Each session has at most one.
+func (refreshToken RefreshToken) IsSession(now time.Time) bool {
+	return refreshToken.RotatedAt == nil && !refreshToken.ExpiresAt.Before(now)
+}
+
+// Client describes who a refresh token is issued to, so users can tell their
+// sessions apart.
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+var (
+	ErrRefreshTokenDoesNotExist = errors.New("Refresh token doesn't exist")
+	ErrRefreshTokenExpired      = errors.New("Refresh token expired")
+	ErrRefreshTokenReused       = errors.New("Refresh token was already rotated")
+)
+
+// hashRefreshToken returns the digest a refresh token is stored and looked up
+// by. Tokens are long random strings, so an unsalted hash can't be reversed
+// by guessing.
+func hashRefreshToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+func newFamilyId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
 
-func (db *DB) CreateRefreshToken(userId int, token string, expiresAt time.Time) error {
-	dbStructure, err := db.loadDB()
+// CreateRefreshToken stores token as the first of a new token family and
+// returns it.
+func (db *DB) CreateRefreshToken(userId int, token string, expiresAt time.Time, client Client) (RefreshToken, error) {
+	familyId, err := newFamilyId()
 	if err != nil {
-		return ErrDatabaseLoad
+		return RefreshToken{}, ErrDatabaseWrite
 	}
 
+	now := time.Now().UTC()
 	refreshToken := RefreshToken{
-		UserId:    userId,
-		Token:     token,
-		ExpiresAt: expiresAt,
+		UserId:     userId,
+		TokenHash:  hashRefreshToken(token),
+		FamilyId:   familyId,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
 	}
-	dbStructure.RefreshTokens[token] = refreshToken
 
-	err = db.writeDB(dbStructure)
+	err = db.Update(func(dbStructure *DBStructure) error {
+		dbStructure.PutRefreshToken(refreshToken)
+		return nil
+	})
+
 	if err != nil {
-		return ErrDatabaseWrite
+		return RefreshToken{}, err
 	}
 
-	return nil
+	return refreshToken, nil
 }
 
-func (db *DB) DeleteRefreshToken(token string) error {
-	dbStructure, err := db.loadDB()
+// RotateRefreshToken exchanges token for newToken, which joins token's
+// family, expires at expiresAt and records client, and returns the new token
+// with its user.
+//
+// A token can be rotated once. Presenting it again means two parties hold
+// it, so the whole family is revoked and ErrRefreshTokenReused is returned
+// along with the reused token.
+func (db *DB) RotateRefreshToken(token, newToken string, expiresAt time.Time, client Client) (User, RefreshToken, error) {
+	var user User
+	var refreshToken RefreshToken
+	reused := false
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		refreshToken, ok = dbStructure.RefreshTokens[hashRefreshToken(token)]
+		if !ok {
+			return ErrRefreshTokenDoesNotExist
+		}
+
+		if refreshToken.RotatedAt != nil {
+			// Revoking is a change to keep, so it can't be reported by
+			// failing the transaction.
+			reused = true
+			for _, member := range dbStructure.refreshTokenFamily(refreshToken) {
+				dbStructure.DeleteRefreshToken(member)
+			}
+			return nil
+		}
+
+		now := time.Now().UTC()
+		if refreshToken.ExpiresAt.Before(now) {
+			return ErrRefreshTokenExpired
+		}
+
+		user, ok = dbStructure.Users[refreshToken.UserId]
+		if !ok {
+			return ErrUserDoesNotExist
+		}
+
+		refreshToken.RotatedAt = &now
+		dbStructure.PutRefreshToken(refreshToken)
+
+		refreshToken = RefreshToken{
+			UserId:     refreshToken.UserId,
+			TokenHash:  hashRefreshToken(newToken),
+			FamilyId:   refreshToken.FamilyId,
+			ExpiresAt:  expiresAt,
+			CreatedAt:  refreshToken.CreatedAt,
+			LastUsedAt: now,
+			UserAgent:  client.UserAgent,
+			IP:         client.IP,
+		}
+		dbStructure.PutRefreshToken(refreshToken)
+		return nil
+	})
+
 	if err != nil {
-		return ErrDatabaseLoad
+		return User{}, RefreshToken{}, err
+	}
+
+	if reused {
+		return User{}, refreshToken, ErrRefreshTokenReused
+	}
+
+	return user, refreshToken, nil
+}
+
+// refreshTokenFamily returns the tokens in refreshToken's family.
+func (dbStructure *DBStructure) refreshTokenFamily(refreshToken RefreshToken) []string {
+	family := []string{}
+	for tokenHash := range dbStructure.idx.refreshTokensByUser[refreshToken.UserId] {
+		if dbStructure.RefreshTokens[tokenHash].FamilyId == refreshToken.FamilyId {
+			family = append(family, tokenHash)
+		}
 	}
+	return family
+}
+
+func (db *DB) DeleteRefreshToken(token string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		dbStructure.DeleteRefreshToken(hashRefreshToken(token))
+		return nil
+	})
+}
 
-	delete(dbStructure.RefreshTokens, token)
+// RevokeRefreshTokenFamily revokes every token in the user's family with
+// familyId, and returns ErrRefreshTokenDoesNotExist if the user has none.
+func (db *DB) RevokeRefreshTokenFamily(userId int, familyId string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		family := dbStructure.refreshTokenFamily(RefreshToken{UserId: userId, FamilyId: familyId})
+		if len(family) == 0 {
+			return ErrRefreshTokenDoesNotExist
+		}
+
+		for _, member := range family {
+			dbStructure.DeleteRefreshToken(member)
+		}
+		return nil
+	})
+}
+
+// IsRefreshTokenFamilyActive reports whether the user's family with familyId
+// still has a token that can be rotated, which is what keeps its session
+// signed in.
+func (db *DB) IsRefreshTokenFamilyActive(userId int, familyId string) (bool, error) {
+	active := false
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, tokenHash := range dbStructure.refreshTokenFamily(RefreshToken{UserId: userId, FamilyId: familyId}) {
+			if dbStructure.RefreshTokens[tokenHash].RotatedAt == nil {
+				active = true
+			}
+		}
+		return nil
+	})
 
-	err = db.writeDB(dbStructure)
 	if err != nil {
-		return ErrDatabaseWrite
+		return false, err
 	}
 
-	return nil
+	return active, nil
 }
 
-func (db *DB) GetUserAndRefreshTokenByRefreshToken(token string) (User, RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+// RevokeSessionsByUser signs the user out everywhere: it revokes every
+// refresh token they hold and bumps their token version, so their access
+// tokens go too. It returns how many sessions were still live, as
+// GetRefreshTokensByUser would have listed them.
+func (db *DB) RevokeSessionsByUser(userId int) (int, error) {
+	revoked := 0
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+
+		if !ok {
+			return ErrUserDoesNotExist
+		}
+
+		revoked = dbStructure.revokeRefreshTokensByUser(userId)
+
+		user.TokenVersion++
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.PutUser(user)
+		return nil
+	})
+
 	if err != nil {
-		return User{}, RefreshToken{}, ErrDatabaseLoad
+		return 0, err
 	}
 
-	refreshToken, ok := dbStructure.RefreshTokens[token]
-	if !ok {
-		return User{}, RefreshToken{}, ErrRefreshTokenDoesNotExist
+	return revoked, nil
+}
+
+// revokeRefreshTokensByUser deletes every token the user holds and returns
+// how many live sessions they made up.
+func (dbStructure *DBStructure) revokeRefreshTokensByUser(userId int) int {
+	now := time.Now().UTC()
+	revoked := 0
+	for tokenHash := range dbStructure.idx.refreshTokensByUser[userId] {
+		if dbStructure.RefreshTokens[tokenHash].IsSession(now) {
+			revoked++
+		}
+		dbStructure.DeleteRefreshToken(tokenHash)
 	}
+	return revoked
+}
+
+func (db *DB) GetUserAndRefreshTokenByRefreshToken(token string) (User, RefreshToken, error) {
+	var user User
+	var refreshToken RefreshToken
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		refreshToken, ok = dbStructure.RefreshTokens[hashRefreshToken(token)]
+		if !ok {
+			return ErrRefreshTokenDoesNotExist
+		}
+
+		user, ok = dbStructure.Users[refreshToken.UserId]
+		if !ok {
+			return ErrUserDoesNotExist
+		}
+		return nil
+	})
 
-	user, err := db.GetUserById(refreshToken.UserId)
 	if err != nil {
 		return User{}, RefreshToken{}, err
 	}
 
 	return user, refreshToken, nil
 }
+
+// PurgeExpiredRefreshTokens deletes tokens that expired before cutoff and
+// returns how many there were. Rotated tokens are kept to detect reuse, but
+// once expired they can't be rotated anyway, so nothing is lost.
+func (db *DB) PurgeExpiredRefreshTokens(cutoff time.Time) (int, error) {
+	purged := 0
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		for tokenHash, refreshToken := range dbStructure.RefreshTokens {
+			if refreshToken.ExpiresAt.Before(cutoff) {
+				dbStructure.DeleteRefreshToken(tokenHash)
+				purged++
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+func (db *DB) GetRefreshTokensByUser(userId int) ([]RefreshToken, error) {
+	var refreshTokens []RefreshToken
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		tokens := dbStructure.idx.refreshTokensByUser[userId]
+		refreshTokens = make([]RefreshToken, 0, len(tokens))
+
+		for tokenHash := range tokens {
+			refreshTokens = append(refreshTokens, dbStructure.RefreshTokens[tokenHash])
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return refreshTokens, nil
+}
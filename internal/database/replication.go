@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidEvent = errors.New("Event can't be applied")
+
+// Apply replays an event published by another store so a replica can follow
+// a primary. Events carry whole records, so applying one twice is harmless.
+// DatabaseRestored can't be applied; the replica has to resync from a fresh
+// snapshot instead.
+func (db *DB) Apply(event Event) error {
+	err := event.validate()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(dbStructure *DBStructure) error {
+		switch event.Type {
+		case ChirpCreated, ChirpUpdated, ChirpDeleted, ChirpRestored:
+			dbStructure.PutChirp(*event.Chirp)
+		case ChirpPurged:
+			dbStructure.DeleteChirp(event.Chirp.Id)
+		case UserCreated, UserUpdated:
+			dbStructure.PutUser(*event.User)
+		case RefreshTokenCreated, RefreshTokenUpdated:
+			dbStructure.PutRefreshToken(*event.RefreshToken)
+		case RefreshTokenRevoked:
+			dbStructure.DeleteRefreshToken(event.RefreshToken.TokenHash)
+		case AccessTokenRevoked:
+			dbStructure.PutRevokedAccessToken(*event.RevokedAccessToken)
+		case AccessTokenPurged:
+			dbStructure.DeleteRevokedAccessToken(event.RevokedAccessToken.Id)
+		}
+		return nil
+	})
+}
+
+func (event Event) validate() error {
+	var ok bool
+
+	switch event.Type {
+	case ChirpCreated, ChirpUpdated, ChirpDeleted, ChirpRestored, ChirpPurged:
+		ok = event.Chirp != nil
+	case UserCreated, UserUpdated:
+		ok = event.User != nil
+	case RefreshTokenCreated, RefreshTokenUpdated, RefreshTokenRevoked:
+		ok = event.RefreshToken != nil
+	case AccessTokenRevoked, AccessTokenPurged:
+		ok = event.RevokedAccessToken != nil
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrInvalidEvent, event.Type)
+	}
+	return nil
+}
@@ -0,0 +1,1368 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type SQLiteDB struct {
+	db *sql.DB
+	// ids issues explicit ids when set; otherwise AUTOINCREMENT does, which
+	// already never reuses the id of a deleted row.
+	ids IDGenerator
+
+	// writeMu orders writes, so their events are queued in commit order.
+	writeMu sync.Mutex
+	feed
+}
+
+var _ Store = (*SQLiteDB)(nil)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL,
+	password_hash TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0,
+	token_version INTEGER NOT NULL DEFAULT 0,
+	created_at    DATETIME,
+	updated_at    DATETIME
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	body      TEXT    NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users (id),
+	deleted_at DATETIME,
+	created_at DATETIME,
+	updated_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_chirps_author_id ON chirps (author_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash TEXT     PRIMARY KEY,
+	user_id    INTEGER  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	family_id  TEXT,
+	expires_at DATETIME NOT NULL,
+	rotated_at DATETIME,
+	created_at DATETIME,
+	last_used_at DATETIME,
+	user_agent TEXT     NOT NULL DEFAULT '',
+	ip         TEXT     NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+	id         TEXT     PRIMARY KEY,
+	expires_at DATETIME NOT NULL
+);
+`
+
+const sqliteDropSchema = `
+DROP TABLE IF EXISTS revoked_access_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS chirps;
+DROP TABLE IF EXISTS users;
+`
+
+func NewSQLiteDB(path string, opts Options) (*SQLiteDB, error) {
+	if opts.ReadOnly {
+		return openSQLiteReadOnly(path, opts)
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate", path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+
+	if opts.Debug {
+		_, err = db.Exec(sqliteDropSchema)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("problem resetting %s, %v", path, err)
+		}
+	}
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("problem creating schema in %s, %v", path, err)
+	}
+
+	err = upgradeSQLiteSchema(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("problem upgrading schema in %s, %v", path, err)
+	}
+
+	return &SQLiteDB{db: db, ids: opts.IDGenerator}, nil
+}
+
+// openSQLiteReadOnly opens an existing database without creating or
+// upgrading anything in it, for commands such as backup and export.
+func openSQLiteReadOnly(path string, opts Options) (*SQLiteDB, error) {
+	if opts.Debug {
+		return nil, errors.New("debug mode needs a writable database")
+	}
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening %s, %w", path, err)
+	}
+
+	dsn := fmt.Sprintf("file:%s?mode=ro&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+
+	return &SQLiteDB{db: db, ids: opts.IDGenerator}, nil
+}
+
+// Tables created before a column existed don't pick it up from CREATE TABLE
+// IF NOT EXISTS, so upgrades add it. Timestamps on existing rows take the
+// time of the upgrade, as nothing better is known, and refresh tokens issued
+// before rotation each start a family of their own.
+var sqliteAddedColumns = []struct {
+	table       string
+	column      string
+	columnType  string
+	backfill    bool
+	backfillSQL string
+}{
+	{table: "chirps", column: "deleted_at", columnType: "DATETIME"},
+	{table: "chirps", column: "created_at", columnType: "DATETIME", backfill: true},
+	{table: "chirps", column: "updated_at", columnType: "DATETIME", backfill: true},
+	{table: "users", column: "created_at", columnType: "DATETIME", backfill: true},
+	{table: "users", column: "updated_at", columnType: "DATETIME", backfill: true},
+	{table: "users", column: "token_version", columnType: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "refresh_tokens", column: "family_id", columnType: "TEXT", backfillSQL: "lower(hex(randomblob(16)))"},
+	{table: "refresh_tokens", column: "rotated_at", columnType: "DATETIME"},
+	{table: "refresh_tokens", column: "created_at", columnType: "DATETIME", backfill: true},
+	{table: "refresh_tokens", column: "last_used_at", columnType: "DATETIME", backfill: true},
+	{table: "refresh_tokens", column: "user_agent", columnType: "TEXT NOT NULL DEFAULT ''"},
+	{table: "refresh_tokens", column: "ip", columnType: "TEXT NOT NULL DEFAULT ''"},
+}
+
+func upgradeSQLiteSchema(db *sql.DB) error {
+	now := time.Now().UTC()
+
+	for _, added := range sqliteAddedColumns {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, added.table, added.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, added.table, added.column, added.columnType))
+		if err != nil {
+			return err
+		}
+
+		if added.backfill {
+			_, err = db.Exec(fmt.Sprintf(`UPDATE %s SET %s = ?`, added.table, added.column), now)
+			if err != nil {
+				return err
+			}
+		}
+
+		if added.backfillSQL != "" {
+			_, err = db.Exec(fmt.Sprintf(`UPDATE %s SET %s = %s`, added.table, added.column, added.backfillSQL))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := hashSQLiteRefreshTokens(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_chirps_created_at ON chirps (created_at);
+		CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);`)
+	return err
+}
+
+// hashSQLiteRefreshTokens replaces the raw tokens of a table created before
+// refresh tokens were hashed with their digests.
+func hashSQLiteRefreshTokens(db *sql.DB) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('refresh_tokens') WHERE name = 'token'`).Scan(&count)
+	if err != nil || count == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT token_hash FROM refresh_tokens`)
+	if err != nil {
+		return err
+	}
+
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		_, err = tx.Exec(`UPDATE refresh_tokens SET token_hash = ? WHERE token_hash = ?`, hashRefreshToken(token), token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) insert(table, columns string, args ...any) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := s.insertTx(tx, table, columns, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// insertTx inserts a row with a new id into table as part of tx, and returns
+// the id.
+func (s *SQLiteDB) insertTx(tx *sql.Tx, table, columns string, args ...any) (int, error) {
+	if s.ids == nil {
+		result, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (?%s)`, table, columns, strings.Repeat(", ?", len(args)-1)), args...)
+		if err != nil {
+			return 0, err
+		}
+
+		id, err := result.LastInsertId()
+		return int(id), err
+	}
+
+	last, err := lastId(tx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	id := s.ids.NextID(table, last)
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (id, %s) VALUES (?%s)`, table, columns, strings.Repeat(", ?", len(args))), append([]any{id}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// lastId is the highest id ever issued for table, including ids of deleted
+// rows, as AUTOINCREMENT records it.
+func lastId(tx *sql.Tx, table string) (int, error) {
+	var last int
+	err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = ?`, table).Scan(&last)
+	return last, err
+}
+
+// raiseLastId raises the highest id AUTOINCREMENT has issued for table to at
+// least last.
+func raiseLastId(tx *sql.Tx, table string, last int) error {
+	result, err := tx.Exec(`UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?`, last, table)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil || updated > 0 || last == 0 {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)`, table, last)
+	return err
+}
+
+func (s *SQLiteDB) Import(users []User, chirps []Chirp, remapIds bool) error {
+	defer s.lockWrites()()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+	defer tx.Rollback()
+
+	lastUserId, err := lastId(tx, "users")
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	lastChirpId, err := lastId(tx, "chirps")
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+
+	exists := func(query string, args ...any) (bool, error) {
+		var count int
+		err := tx.QueryRow(query, args...).Scan(&count)
+		if err != nil {
+			return false, ErrDatabaseLoad
+		}
+		return count > 0, nil
+	}
+
+	events := []Event{}
+	newUserIds := map[int]int{}
+
+	for _, user := range users {
+		taken, err := exists(`SELECT COUNT(*) FROM users WHERE email = ?`, user.Email)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return fmt.Errorf("%w: %s", ErrUserAlreadyExists, user.Email)
+		}
+
+		if remapIds {
+			id, err := s.insertTx(tx, "users", "email, password_hash, is_chirpy_red, token_version, created_at, updated_at",
+				user.Email, user.PasswordHash, user.IsChirpyRed, user.TokenVersion, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+			if err != nil {
+				return ErrDatabaseWrite
+			}
+			newUserIds[user.Id] = id
+			user.Id = id
+		} else {
+			taken, err := exists(`SELECT COUNT(*) FROM users WHERE id = ?`, user.Id)
+			if err != nil {
+				return err
+			}
+			if taken || user.Id <= lastUserId {
+				return fmt.Errorf("%w: user %d", ErrIdTaken, user.Id)
+			}
+
+			_, err = tx.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				user.Id, user.Email, user.PasswordHash, user.IsChirpyRed, user.TokenVersion, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+			if err != nil {
+				return ErrDatabaseWrite
+			}
+		}
+
+		events = append(events, Event{Type: UserCreated, User: &user})
+	}
+
+	for _, chirp := range chirps {
+		if remapIds {
+			authorId, ok := newUserIds[chirp.AuthorId]
+			if !ok {
+				return fmt.Errorf("%w: author %d of chirp %d", ErrUserDoesNotExist, chirp.AuthorId, chirp.Id)
+			}
+			chirp.AuthorId = authorId
+
+			chirp.Id, err = s.insertTx(tx, "chirps", "body, author_id, deleted_at, created_at, updated_at",
+				chirp.Body, chirp.AuthorId, utcTime(chirp.DeletedAt), chirp.CreatedAt.UTC(), chirp.UpdatedAt.UTC())
+			if err != nil {
+				return ErrDatabaseWrite
+			}
+		} else {
+			found, err := exists(`SELECT COUNT(*) FROM users WHERE id = ?`, chirp.AuthorId)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w: author %d of chirp %d", ErrUserDoesNotExist, chirp.AuthorId, chirp.Id)
+			}
+
+			// Soft-deleted chirps still hold their ids.
+			taken, err := exists(`SELECT COUNT(*) FROM chirps WHERE id = ?`, chirp.Id)
+			if err != nil {
+				return err
+			}
+			if taken || chirp.Id <= lastChirpId {
+				return fmt.Errorf("%w: chirp %d", ErrIdTaken, chirp.Id)
+			}
+
+			_, err = tx.Exec(`INSERT INTO chirps (`+chirpColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+				chirp.Id, chirp.Body, chirp.AuthorId, utcTime(chirp.DeletedAt), chirp.CreatedAt.UTC(), chirp.UpdatedAt.UTC())
+			if err != nil {
+				return ErrDatabaseWrite
+			}
+		}
+
+		events = append(events, Event{Type: ChirpCreated, Chirp: &chirp})
+	}
+
+	if tx.Commit() != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(events...)
+	return nil
+}
+
+// lockWrites holds off other writes until the returned function is called,
+// which then delivers the events the write queued.
+func (s *SQLiteDB) lockWrites() func() {
+	s.writeMu.Lock()
+	return func() {
+		s.writeMu.Unlock()
+		s.flush()
+	}
+}
+
+func (s *SQLiteDB) Close() error {
+	s.closeSubscribers()
+	return s.db.Close()
+}
+
+func (s *SQLiteDB) CreateChirp(body string, authorId int) (Chirp, error) {
+	defer s.lockWrites()()
+
+	now := time.Now().UTC()
+	id, err := s.insert("chirps", "body, author_id, created_at, updated_at", body, authorId, now, now)
+	if err != nil {
+		return Chirp{}, ErrDatabaseWrite
+	}
+
+	chirp := Chirp{
+		Id:        id,
+		Body:      body,
+		AuthorId:  authorId,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	s.queue(Event{Type: ChirpCreated, Chirp: &chirp})
+	return chirp, nil
+}
+
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return s.queryChirps(`SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL`)
+}
+
+func (s *SQLiteDB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	return s.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? AND deleted_at IS NULL`, authorId)
+}
+
+func (s *SQLiteDB) ListChirps(query ChirpQuery) ([]Chirp, error) {
+	where := []string{}
+	args := []any{}
+
+	if !query.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+
+	if query.AuthorId != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, query.AuthorId)
+	}
+	if query.AfterId != 0 {
+		after := "id > ?"
+		if query.ByCreatedAt {
+			after = "(created_at, id) > (?, ?)"
+			args = append(args, query.AfterCreatedAt.UTC())
+		}
+		if query.Descending {
+			after = strings.Replace(after, ">", "<", 1)
+		}
+		where = append(where, after)
+		args = append(args, query.AfterId)
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.Since.UTC())
+	}
+	if !query.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, query.Until.UTC())
+	}
+
+	order := "id ASC"
+	if query.ByCreatedAt {
+		order = "created_at ASC, id ASC"
+	}
+	if query.Descending {
+		order = strings.ReplaceAll(order, "ASC", "DESC")
+	}
+
+	limit := -1
+	if query.Limit != 0 {
+		limit = query.Limit
+	}
+	args = append(args, limit)
+
+	filter := ""
+	if len(where) > 0 {
+		filter = ` WHERE ` + strings.Join(where, " AND ")
+	}
+
+	return s.queryChirps(`SELECT `+chirpColumns+` FROM chirps`+filter+` ORDER BY `+order+` LIMIT ?`, args...)
+}
+
+func (s *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, ErrDatabaseLoad
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, ErrDatabaseLoad
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	if rows.Err() != nil {
+		return nil, ErrDatabaseLoad
+	}
+
+	return chirps, nil
+}
+
+const chirpColumns = "id, body, author_id, deleted_at, created_at, updated_at"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// utcTime binds an optional time in UTC, as the other times are, so that
+// comparisons of the stored strings order it correctly.
+func utcTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func scanChirp(row scanner) (Chirp, error) {
+	var chirp Chirp
+	var deletedAt sql.NullTime
+
+	err := row.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId, &deletedAt, &chirp.CreatedAt, &chirp.UpdatedAt)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	return chirp, nil
+}
+
+func (s *SQLiteDB) GetChirpById(chirpId int) (Chirp, error) {
+	return s.getChirp(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NULL`, chirpId)
+}
+
+func (s *SQLiteDB) GetDeletedChirpById(chirpId int) (Chirp, error) {
+	return s.getChirp(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NOT NULL`, chirpId)
+}
+
+func (s *SQLiteDB) getChirp(query string, args ...any) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow(query, args...))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpDoesNotExist
+	}
+
+	if err != nil {
+		return Chirp{}, ErrDatabaseLoad
+	}
+
+	return chirp, nil
+}
+
+func (s *SQLiteDB) DeleteChirpById(chirpId int) error {
+	defer s.lockWrites()()
+
+	now := time.Now().UTC()
+	chirp, err := scanChirp(s.db.QueryRow(`UPDATE chirps SET deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL RETURNING `+chirpColumns,
+		now, now, chirpId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: ChirpDeleted, Chirp: &chirp})
+	return nil
+}
+
+func (s *SQLiteDB) RestoreChirpById(chirpId int) (Chirp, error) {
+	defer s.lockWrites()()
+
+	chirp, err := scanChirp(s.db.QueryRow(`UPDATE chirps SET deleted_at = NULL, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL RETURNING `+chirpColumns,
+		time.Now().UTC(), chirpId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpDoesNotExist
+	}
+
+	if err != nil {
+		return Chirp{}, ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: ChirpRestored, Chirp: &chirp})
+	return chirp, nil
+}
+
+func (s *SQLiteDB) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	defer s.lockWrites()()
+
+	chirps, err := s.queryChirps(`DELETE FROM chirps WHERE deleted_at < ? RETURNING `+chirpColumns, cutoff.UTC())
+	if err != nil {
+		return 0, ErrDatabaseWrite
+	}
+
+	events := make([]Event, 0, len(chirps))
+	for i := range chirps {
+		events = append(events, Event{Type: ChirpPurged, Chirp: &chirps[i]})
+	}
+	s.queue(events...)
+	return len(chirps), nil
+}
+
+func (s *SQLiteDB) CreateUser(email, passwordHash string) (User, error) {
+	defer s.lockWrites()()
+
+	now := time.Now().UTC()
+	id, err := s.insert("users", "email, password_hash, created_at, updated_at", email, passwordHash, now, now)
+	if isUniqueViolation(err) {
+		return User{}, ErrUserAlreadyExists
+	}
+
+	if err != nil {
+		return User{}, ErrDatabaseWrite
+	}
+
+	user := User{
+		Id:           id,
+		Email:        email,
+		PasswordHash: passwordHash,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	s.queue(Event{Type: UserCreated, User: &user})
+	return user, nil
+}
+
+func (s *SQLiteDB) GetUsers() ([]User, error) {
+	return s.queryUsers(`SELECT ` + userColumns + ` FROM users`)
+}
+
+func (s *SQLiteDB) ListUsers(afterId, limit int) ([]User, error) {
+	if limit == 0 {
+		limit = -1
+	}
+	return s.queryUsers(`SELECT `+userColumns+` FROM users WHERE id > ? ORDER BY id LIMIT ?`, afterId, limit)
+}
+
+func (s *SQLiteDB) queryUsers(query string, args ...any) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, ErrDatabaseLoad
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, ErrDatabaseLoad
+		}
+		users = append(users, user)
+	}
+
+	if rows.Err() != nil {
+		return nil, ErrDatabaseLoad
+	}
+
+	return users, nil
+}
+
+func (s *SQLiteDB) GetUserById(userId int) (User, error) {
+	return s.getUser(`SELECT `+userColumns+` FROM users WHERE id = ?`, userId)
+}
+
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return s.getUser(`SELECT `+userColumns+` FROM users WHERE email = ?`, email)
+}
+
+const userColumns = "id, email, password_hash, is_chirpy_red, token_version, created_at, updated_at"
+
+func scanUser(row scanner) (User, error) {
+	var user User
+	err := row.Scan(&user.Id, &user.Email, &user.PasswordHash, &user.IsChirpyRed, &user.TokenVersion, &user.CreatedAt, &user.UpdatedAt)
+	return user, err
+}
+
+func (s *SQLiteDB) getUser(query string, arg any) (User, error) {
+	user, err := scanUser(s.db.QueryRow(query, arg))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserDoesNotExist
+	}
+
+	if err != nil {
+		return User{}, ErrDatabaseLoad
+	}
+
+	return user, nil
+}
+
+func (s *SQLiteDB) UpdateUserEmailPasswordById(userId int, email, passwordHash string) (User, error) {
+	defer s.lockWrites()()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, ErrDatabaseWrite
+	}
+	defer tx.Rollback()
+
+	var oldPasswordHash string
+	err = tx.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, userId).Scan(&oldPasswordHash)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserDoesNotExist
+	}
+
+	if err != nil {
+		return User{}, ErrDatabaseLoad
+	}
+
+	// A new password hash bumps the token version and revokes the refresh
+	// tokens issued under the old one.
+	changed := passwordHash != oldPasswordHash
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE users SET token_version = token_version + ?, email = ?, password_hash = ?, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns, changed, email, passwordHash, time.Now().UTC(), userId))
+	if isUniqueViolation(err) {
+		return User{}, ErrUserAlreadyExists
+	}
+
+	if err != nil {
+		return User{}, ErrDatabaseWrite
+	}
+
+	revoked := []RefreshToken{}
+	if changed {
+		revoked, err = queryRefreshTokens(tx, `DELETE FROM refresh_tokens WHERE user_id = ? RETURNING `+refreshTokenColumns, userId)
+		if err != nil {
+			return User{}, ErrDatabaseWrite
+		}
+	}
+
+	if tx.Commit() != nil {
+		return User{}, ErrDatabaseWrite
+	}
+
+	events := []Event{{Type: UserUpdated, User: &user}}
+	for i := range revoked {
+		events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: &revoked[i]})
+	}
+	s.queue(events...)
+	return user, nil
+}
+
+func (s *SQLiteDB) UpgradeUserToRedByUserId(userId int) error {
+	defer s.lockWrites()()
+
+	user, err := scanUser(s.db.QueryRow(`
+		UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ? AND is_chirpy_red = 0
+		RETURNING `+userColumns, time.Now().UTC(), userId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = s.GetUserById(userId)
+		return err
+	}
+
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: UserUpdated, User: &user})
+	return nil
+}
+
+const refreshTokenColumns = "user_id, token_hash, family_id, expires_at, rotated_at, created_at, last_used_at, user_agent, ip"
+
+func scanRefreshToken(row scanner) (RefreshToken, error) {
+	var refreshToken RefreshToken
+	var rotatedAt sql.NullTime
+
+	err := row.Scan(&refreshToken.UserId, &refreshToken.TokenHash, &refreshToken.FamilyId, &refreshToken.ExpiresAt, &rotatedAt,
+		&refreshToken.CreatedAt, &refreshToken.LastUsedAt, &refreshToken.UserAgent, &refreshToken.IP)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	if rotatedAt.Valid {
+		refreshToken.RotatedAt = &rotatedAt.Time
+	}
+	return refreshToken, nil
+}
+
+func insertRefreshToken(db execer, refreshToken RefreshToken) error {
+	_, err := db.Exec(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		refreshToken.UserId, refreshToken.TokenHash, refreshToken.FamilyId, refreshToken.ExpiresAt.UTC(), utcTime(refreshToken.RotatedAt),
+		refreshToken.CreatedAt.UTC(), refreshToken.LastUsedAt.UTC(), refreshToken.UserAgent, refreshToken.IP)
+	return err
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *SQLiteDB) CreateRefreshToken(userId int, token string, expiresAt time.Time, client Client) (RefreshToken, error) {
+	defer s.lockWrites()()
+
+	familyId, err := newFamilyId()
+	if err != nil {
+		return RefreshToken{}, ErrDatabaseWrite
+	}
+
+	now := time.Now().UTC()
+	refreshToken := RefreshToken{
+		UserId:     userId,
+		TokenHash:  hashRefreshToken(token),
+		FamilyId:   familyId,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	err = insertRefreshToken(s.db, refreshToken)
+	if err != nil {
+		return RefreshToken{}, ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: RefreshTokenCreated, RefreshToken: &refreshToken})
+	return refreshToken, nil
+}
+
+func (s *SQLiteDB) DeleteRefreshToken(token string) error {
+	defer s.lockWrites()()
+
+	refreshToken, err := scanRefreshToken(s.db.QueryRow(`DELETE FROM refresh_tokens WHERE token_hash = ? RETURNING `+refreshTokenColumns, hashRefreshToken(token)))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: RefreshTokenRevoked, RefreshToken: &refreshToken})
+	return nil
+}
+
+func (s *SQLiteDB) RotateRefreshToken(token, newToken string, expiresAt time.Time, client Client) (User, RefreshToken, error) {
+	defer s.lockWrites()()
+
+	tokenHash := hashRefreshToken(token)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, RefreshToken{}, ErrDatabaseWrite
+	}
+	defer tx.Rollback()
+
+	refreshToken, err := scanRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, tokenHash))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, RefreshToken{}, ErrRefreshTokenDoesNotExist
+	}
+
+	if err != nil {
+		return User{}, RefreshToken{}, ErrDatabaseLoad
+	}
+
+	if refreshToken.RotatedAt != nil {
+		revoked, err := queryRefreshTokens(tx, `DELETE FROM refresh_tokens WHERE family_id = ? RETURNING `+refreshTokenColumns, refreshToken.FamilyId)
+		if err != nil || tx.Commit() != nil {
+			return User{}, RefreshToken{}, ErrDatabaseWrite
+		}
+
+		events := make([]Event, 0, len(revoked))
+		for i := range revoked {
+			events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: &revoked[i]})
+		}
+		s.queue(events...)
+		return User{}, refreshToken, ErrRefreshTokenReused
+	}
+
+	now := time.Now().UTC()
+	if refreshToken.ExpiresAt.Before(now) {
+		return User{}, RefreshToken{}, ErrRefreshTokenExpired
+	}
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, refreshToken.UserId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, RefreshToken{}, ErrUserDoesNotExist
+	}
+
+	if err != nil {
+		return User{}, RefreshToken{}, ErrDatabaseLoad
+	}
+
+	refreshToken.RotatedAt = &now
+	_, err = tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ?`, now, tokenHash)
+	if err != nil {
+		return User{}, RefreshToken{}, ErrDatabaseWrite
+	}
+
+	rotated := RefreshToken{
+		UserId:     user.Id,
+		TokenHash:  hashRefreshToken(newToken),
+		FamilyId:   refreshToken.FamilyId,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  refreshToken.CreatedAt,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	err = insertRefreshToken(tx, rotated)
+	if err != nil || tx.Commit() != nil {
+		return User{}, RefreshToken{}, ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: RefreshTokenUpdated, RefreshToken: &refreshToken}, Event{Type: RefreshTokenCreated, RefreshToken: &rotated})
+	return user, rotated, nil
+}
+
+func (s *SQLiteDB) RevokeRefreshTokenFamily(userId int, familyId string) error {
+	defer s.lockWrites()()
+
+	revoked, err := queryRefreshTokens(s.db, `DELETE FROM refresh_tokens WHERE user_id = ? AND family_id = ? RETURNING `+refreshTokenColumns, userId, familyId)
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	if len(revoked) == 0 {
+		return ErrRefreshTokenDoesNotExist
+	}
+
+	events := make([]Event, 0, len(revoked))
+	for i := range revoked {
+		events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: &revoked[i]})
+	}
+	s.queue(events...)
+	return nil
+}
+
+func (s *SQLiteDB) IsRefreshTokenFamilyActive(userId int, familyId string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM refresh_tokens WHERE user_id = ? AND family_id = ? AND rotated_at IS NULL`, userId, familyId).Scan(&count)
+	if err != nil {
+		return false, ErrDatabaseLoad
+	}
+
+	return count > 0, nil
+}
+
+func (s *SQLiteDB) RevokeSessionsByUser(userId int) (int, error) {
+	defer s.lockWrites()()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, ErrDatabaseWrite
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE users SET token_version = token_version + 1, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns, time.Now().UTC(), userId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserDoesNotExist
+	}
+
+	if err != nil {
+		return 0, ErrDatabaseWrite
+	}
+
+	revoked, err := queryRefreshTokens(tx, `DELETE FROM refresh_tokens WHERE user_id = ? RETURNING `+refreshTokenColumns, userId)
+	if err != nil || tx.Commit() != nil {
+		return 0, ErrDatabaseWrite
+	}
+
+	now := time.Now().UTC()
+	sessions := 0
+	events := []Event{{Type: UserUpdated, User: &user}}
+	for i := range revoked {
+		if revoked[i].IsSession(now) {
+			sessions++
+		}
+		events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: &revoked[i]})
+	}
+	s.queue(events...)
+	return sessions, nil
+}
+
+func (s *SQLiteDB) GetUserAndRefreshTokenByRefreshToken(token string) (User, RefreshToken, error) {
+	refreshToken, err := scanRefreshToken(s.db.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, hashRefreshToken(token)))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, RefreshToken{}, ErrRefreshTokenDoesNotExist
+	}
+
+	if err != nil {
+		return User{}, RefreshToken{}, ErrDatabaseLoad
+	}
+
+	user, err := s.getUser(`SELECT `+userColumns+` FROM users WHERE id = ?`, refreshToken.UserId)
+	if err != nil {
+		return User{}, RefreshToken{}, err
+	}
+
+	return user, refreshToken, nil
+}
+
+func (s *SQLiteDB) GetRefreshTokensByUser(userId int) ([]RefreshToken, error) {
+	refreshTokens, err := queryRefreshTokens(s.db, `SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = ?`, userId)
+	if err != nil {
+		return nil, ErrDatabaseLoad
+	}
+
+	return refreshTokens, nil
+}
+
+func (s *SQLiteDB) PurgeExpiredRefreshTokens(cutoff time.Time) (int, error) {
+	defer s.lockWrites()()
+
+	purged, err := queryRefreshTokens(s.db, `DELETE FROM refresh_tokens WHERE expires_at < ? RETURNING `+refreshTokenColumns, cutoff.UTC())
+	if err != nil {
+		return 0, ErrDatabaseWrite
+	}
+
+	events := make([]Event, 0, len(purged))
+	for i := range purged {
+		events = append(events, Event{Type: RefreshTokenRevoked, RefreshToken: &purged[i]})
+	}
+	s.queue(events...)
+	return len(purged), nil
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryRefreshTokens(db querier, query string, args ...any) ([]RefreshToken, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refreshTokens := []RefreshToken{}
+	for rows.Next() {
+		refreshToken, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		refreshTokens = append(refreshTokens, refreshToken)
+	}
+
+	return refreshTokens, rows.Err()
+}
+
+const revokedAccessTokenColumns = "id, expires_at"
+
+func (s *SQLiteDB) RevokeAccessToken(id string, expiresAt time.Time) error {
+	defer s.lockWrites()()
+
+	revoked := RevokedAccessToken{Id: id, ExpiresAt: expiresAt}
+	_, err := s.db.Exec(`INSERT INTO revoked_access_tokens (`+revokedAccessTokenColumns+`) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at`,
+		revoked.Id, revoked.ExpiresAt.UTC())
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: AccessTokenRevoked, RevokedAccessToken: &revoked})
+	return nil
+}
+
+func (s *SQLiteDB) IsAccessTokenRevoked(id string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_access_tokens WHERE id = ?`, id).Scan(&count)
+	if err != nil {
+		return false, ErrDatabaseLoad
+	}
+
+	return count > 0, nil
+}
+
+func (s *SQLiteDB) PurgeRevokedAccessTokens(cutoff time.Time) (int, error) {
+	defer s.lockWrites()()
+
+	purged, err := queryRevokedAccessTokens(s.db, `DELETE FROM revoked_access_tokens WHERE expires_at < ? RETURNING `+revokedAccessTokenColumns, cutoff.UTC())
+	if err != nil {
+		return 0, ErrDatabaseWrite
+	}
+
+	events := make([]Event, 0, len(purged))
+	for i := range purged {
+		events = append(events, Event{Type: AccessTokenPurged, RevokedAccessToken: &purged[i]})
+	}
+	s.queue(events...)
+	return len(purged), nil
+}
+
+func queryRevokedAccessTokens(db querier, query string, args ...any) ([]RevokedAccessToken, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revokedAccessTokens := []RevokedAccessToken{}
+	for rows.Next() {
+		var revoked RevokedAccessToken
+		err := rows.Scan(&revoked.Id, &revoked.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		revokedAccessTokens = append(revokedAccessTokens, revoked)
+	}
+
+	return revokedAccessTokens, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+func (s *SQLiteDB) Backup(w io.Writer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	defer tx.Rollback()
+
+	dbStructure := newDBStructure()
+
+	rows, err := tx.Query(`SELECT ` + userColumns + ` FROM users`)
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return ErrDatabaseLoad
+		}
+		dbStructure.Users[user.Id] = user
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`SELECT ` + chirpColumns + ` FROM chirps`)
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			rows.Close()
+			return ErrDatabaseLoad
+		}
+		dbStructure.Chirps[chirp.Id] = chirp
+	}
+	rows.Close()
+
+	refreshTokens, err := queryRefreshTokens(tx, `SELECT `+refreshTokenColumns+` FROM refresh_tokens`)
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	for _, refreshToken := range refreshTokens {
+		dbStructure.RefreshTokens[refreshToken.TokenHash] = refreshToken
+	}
+
+	revokedAccessTokens, err := queryRevokedAccessTokens(tx, `SELECT `+revokedAccessTokenColumns+` FROM revoked_access_tokens`)
+	if err != nil {
+		return ErrDatabaseLoad
+	}
+	for _, revoked := range revokedAccessTokens {
+		dbStructure.RevokedAccessTokens[revoked.Id] = revoked
+	}
+
+	for _, table := range []string{usersSequence, chirpsSequence} {
+		last, err := lastId(tx, table)
+		if err != nil {
+			return ErrDatabaseLoad
+		}
+		dbStructure.advanceSequence(table, last)
+	}
+
+	return writeSnapshot(w, &dbStructure, nil)
+}
+
+func (s *SQLiteDB) Restore(r io.Reader) error {
+	defer s.lockWrites()()
+
+	snapshot, err := readSnapshot(r, nil, false)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM revoked_access_tokens; DELETE FROM refresh_tokens; DELETE FROM chirps; DELETE FROM users;`)
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	for _, user := range snapshot.Users {
+		_, err = tx.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			user.Id, user.Email, user.PasswordHash, user.IsChirpyRed, user.TokenVersion, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+		if err != nil {
+			return ErrDatabaseWrite
+		}
+	}
+
+	for _, chirp := range snapshot.Chirps {
+		_, err = tx.Exec(`INSERT INTO chirps (`+chirpColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+			chirp.Id, chirp.Body, chirp.AuthorId, utcTime(chirp.DeletedAt), chirp.CreatedAt.UTC(), chirp.UpdatedAt.UTC())
+		if err != nil {
+			return ErrDatabaseWrite
+		}
+	}
+
+	for _, refreshToken := range snapshot.RefreshTokens {
+		err = insertRefreshToken(tx, refreshToken)
+		if err != nil {
+			return ErrDatabaseWrite
+		}
+	}
+
+	for _, revoked := range snapshot.RevokedAccessTokens {
+		_, err = tx.Exec(`INSERT INTO revoked_access_tokens (`+revokedAccessTokenColumns+`) VALUES (?, ?)`, revoked.Id, revoked.ExpiresAt.UTC())
+		if err != nil {
+			return ErrDatabaseWrite
+		}
+	}
+
+	// Ids of records purged before the backup stay retired, as do ids issued
+	// since, which AUTOINCREMENT keeps through the deletes above.
+	snapshot.syncSequences()
+	for _, table := range []string{usersSequence, chirpsSequence} {
+		err = raiseLastId(tx, table, snapshot.Sequences[table])
+		if err != nil {
+			return ErrDatabaseWrite
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: DatabaseRestored})
+	return nil
+}
+
+func (s *SQLiteDB) Apply(event Event) error {
+	defer s.lockWrites()()
+
+	err := event.validate()
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case ChirpCreated, ChirpUpdated, ChirpDeleted, ChirpRestored:
+		chirp := event.Chirp
+		_, err = s.db.Exec(`INSERT INTO chirps (`+chirpColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET body = excluded.body, author_id = excluded.author_id, deleted_at = excluded.deleted_at,
+				created_at = excluded.created_at, updated_at = excluded.updated_at`,
+			chirp.Id, chirp.Body, chirp.AuthorId, utcTime(chirp.DeletedAt), chirp.CreatedAt.UTC(), chirp.UpdatedAt.UTC())
+	case ChirpPurged:
+		_, err = s.db.Exec(`DELETE FROM chirps WHERE id = ?`, event.Chirp.Id)
+	case UserCreated, UserUpdated:
+		user := event.User
+		_, err = s.db.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET email = excluded.email, password_hash = excluded.password_hash, is_chirpy_red = excluded.is_chirpy_red,
+				token_version = excluded.token_version, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+			user.Id, user.Email, user.PasswordHash, user.IsChirpyRed, user.TokenVersion, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+	case RefreshTokenCreated, RefreshTokenUpdated:
+		refreshToken := event.RefreshToken
+		_, err = s.db.Exec(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (token_hash) DO UPDATE SET user_id = excluded.user_id, family_id = excluded.family_id,
+				expires_at = excluded.expires_at, rotated_at = excluded.rotated_at, created_at = excluded.created_at,
+				last_used_at = excluded.last_used_at, user_agent = excluded.user_agent, ip = excluded.ip`,
+			refreshToken.UserId, refreshToken.TokenHash, refreshToken.FamilyId, refreshToken.ExpiresAt.UTC(), utcTime(refreshToken.RotatedAt),
+			refreshToken.CreatedAt.UTC(), refreshToken.LastUsedAt.UTC(), refreshToken.UserAgent, refreshToken.IP)
+	case RefreshTokenRevoked:
+		_, err = s.db.Exec(`DELETE FROM refresh_tokens WHERE token_hash = ?`, event.RefreshToken.TokenHash)
+	case AccessTokenRevoked:
+		revoked := event.RevokedAccessToken
+		_, err = s.db.Exec(`INSERT INTO revoked_access_tokens (`+revokedAccessTokenColumns+`) VALUES (?, ?)
+			ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at`,
+			revoked.Id, revoked.ExpiresAt.UTC())
+	case AccessTokenPurged:
+		_, err = s.db.Exec(`DELETE FROM revoked_access_tokens WHERE id = ?`, event.RevokedAccessToken.Id)
+	}
+
+	if err != nil {
+		return ErrDatabaseWrite
+	}
+
+	s.queue(Event{Type: event.Type, Chirp: event.Chirp, User: event.User, RefreshToken: event.RefreshToken, RevokedAccessToken: event.RevokedAccessToken})
+	return nil
+}
@@ -0,0 +1,306 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	_, err = db.CreateUser("user@example.com", "hash")
+	if err != ErrUserAlreadyExists {
+		t.Errorf("creating duplicate user, got: %v, want: %v", err, ErrUserAlreadyExists)
+	}
+
+	chirp, err := db.CreateChirp("hello", user.Id)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	got, err := db.GetChirpById(chirp.Id)
+	if err != nil || got != chirp {
+		t.Errorf("GetChirpById, got: %+v, %v, want: %+v", got, err, chirp)
+	}
+
+	err = db.UpgradeUserToRedByUserId(user.Id)
+	if err != nil {
+		t.Fatalf("error upgrading user: %v", err)
+	}
+
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	_, err = db.CreateRefreshToken(user.Id, "token", expiresAt, Client{})
+	if err != nil {
+		t.Fatalf("error creating refresh token: %v", err)
+	}
+
+	gotUser, refreshToken, err := db.GetUserAndRefreshTokenByRefreshToken("token")
+	if err != nil {
+		t.Fatalf("error getting refresh token: %v", err)
+	}
+
+	if !gotUser.IsChirpyRed || !refreshToken.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("GetUserAndRefreshTokenByRefreshToken, got: %+v, %+v", gotUser, refreshToken)
+	}
+
+	err = db.DeleteChirpById(chirp.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	_, err = db.GetChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("GetChirpById after delete, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+}
+
+func TestSQLiteDBIdGenerator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	db, err := NewSQLiteDB(path, Options{IDGenerator: &SnowflakeGenerator{Node: 1}})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	_, err = db.CreateUser("user@example.com", "hash")
+	if err != ErrUserAlreadyExists {
+		t.Errorf("creating duplicate user, got: %v, want: %v", err, ErrUserAlreadyExists)
+	}
+
+	chirp, err := db.CreateChirp("hello", user.Id)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	if chirp.Id < 1<<22 {
+		t.Errorf("CreateChirp id, got: %d, want a snowflake id", chirp.Id)
+	}
+
+	err = db.DeleteChirpById(chirp.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+	db.Close()
+
+	db, err = NewSQLiteDB(path, Options{IDGenerator: SequenceGenerator{}})
+	if err != nil {
+		t.Fatalf("error reopening database: %v", err)
+	}
+	defer db.Close()
+
+	next, err := db.CreateChirp("again", user.Id)
+	if err != nil {
+		t.Fatalf("error creating chirp: %v", err)
+	}
+
+	if next.Id != chirp.Id+1 {
+		t.Errorf("CreateChirp id, got: %d, want: %d", next.Id, chirp.Id+1)
+	}
+}
+
+func TestSQLiteDBSoftDelete(t *testing.T) {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	user, _ := db.CreateUser("user@example.com", "hash")
+	chirp, _ := db.CreateChirp("hello", user.Id)
+
+	err = db.DeleteChirpById(chirp.Id)
+	if err != nil {
+		t.Fatalf("error deleting chirp: %v", err)
+	}
+
+	_, err = db.GetChirpById(chirp.Id)
+	if err != ErrChirpDoesNotExist {
+		t.Errorf("GetChirpById after delete, got: %v, want: %v", err, ErrChirpDoesNotExist)
+	}
+
+	deleted, err := db.GetDeletedChirpById(chirp.Id)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Fatalf("GetDeletedChirpById, got: %+v, %v", deleted, err)
+	}
+
+	restored, err := db.RestoreChirpById(chirp.Id)
+	if err != nil || restored.DeletedAt != nil {
+		t.Fatalf("RestoreChirpById, got: %+v, %v", restored, err)
+	}
+
+	db.DeleteChirpById(chirp.Id)
+
+	purged, err := db.PurgeDeletedChirps(time.Now().Add(time.Minute))
+	if err != nil || purged != 1 {
+		t.Errorf("PurgeDeletedChirps, got: %d, %v, want: 1", purged, err)
+	}
+}
+
+func TestSQLiteDBUpgradesSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	_, err = old.Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL, password_hash TEXT NOT NULL, is_chirpy_red INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE chirps (id INTEGER PRIMARY KEY AUTOINCREMENT, body TEXT NOT NULL, author_id INTEGER NOT NULL REFERENCES users (id));
+		CREATE TABLE refresh_tokens (token TEXT PRIMARY KEY, user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE, expires_at DATETIME NOT NULL);
+		INSERT INTO users (email, password_hash) VALUES ('user@example.com', 'hash');
+		INSERT INTO chirps (body, author_id) VALUES ('hello', 1);
+		INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES ('first', 1, '2030-01-01 00:00:00'), ('second', 1, '2030-01-01 00:00:00');`)
+	if err != nil {
+		t.Fatalf("error creating old schema: %v", err)
+	}
+	old.Close()
+
+	db, err := NewSQLiteDB(path, Options{})
+	if err != nil {
+		t.Fatalf("error upgrading database: %v", err)
+	}
+	defer db.Close()
+
+	chirp, err := db.GetChirpById(1)
+	if err != nil || chirp.CreatedAt.IsZero() || chirp.UpdatedAt.IsZero() {
+		t.Errorf("GetChirpById, got: %+v, %v, want backfilled timestamps", chirp, err)
+	}
+
+	user, err := db.GetUserById(1)
+	if err != nil || user.CreatedAt.IsZero() {
+		t.Errorf("GetUserById, got: %+v, %v, want backfilled timestamps", user, err)
+	}
+
+	refreshTokens, err := db.GetRefreshTokensByUser(1)
+	if err != nil || len(refreshTokens) != 2 || refreshTokens[0].FamilyId == "" || refreshTokens[0].FamilyId == refreshTokens[1].FamilyId {
+		t.Errorf("GetRefreshTokensByUser, got: %+v, %v, want a family of its own per token", refreshTokens, err)
+	}
+
+	_, refreshToken, err := db.GetUserAndRefreshTokenByRefreshToken("first")
+	if err != nil || refreshToken.TokenHash != hashRefreshToken("first") || refreshToken.CreatedAt.IsZero() || refreshToken.LastUsedAt.IsZero() {
+		t.Errorf("GetUserAndRefreshTokenByRefreshToken, got: %+v, %v, want the token stored hashed and timestamped", refreshToken, err)
+	}
+}
+
+func TestSQLiteDBPurgesImportedDeletionsInUTC(t *testing.T) {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Deleted at 05:00 UTC, written in a zone whose clock then read 10:00.
+	deletedAt := time.Date(2024, 1, 2, 10, 0, 0, 0, time.FixedZone("UTC+5", 5*60*60))
+	err = db.Import(
+		[]User{{Id: 1, Email: "user@example.com", CreatedAt: createdAt, UpdatedAt: createdAt}},
+		[]Chirp{{Id: 2, Body: "deleted", AuthorId: 1, DeletedAt: &deletedAt, CreatedAt: createdAt, UpdatedAt: createdAt}},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("error importing: %v", err)
+	}
+
+	purged, err := db.PurgeDeletedChirps(time.Date(2024, 1, 2, 7, 0, 0, 0, time.UTC))
+	if err != nil || purged != 1 {
+		t.Errorf("PurgeDeletedChirps, got: %d, %v, want: 1", purged, err)
+	}
+}
+
+func TestSQLiteDBRestoreRetiresPurgedIds(t *testing.T) {
+	source, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer source.Close()
+
+	user, _ := source.CreateUser("user@example.com", "hash")
+	source.CreateChirp("kept", user.Id)
+	purged, _ := source.CreateChirp("purged", user.Id)
+	source.DeleteChirpById(purged.Id)
+	source.PurgeDeletedChirps(time.Now().Add(time.Minute))
+
+	var snapshot bytes.Buffer
+	err = source.Backup(&snapshot)
+	if err != nil {
+		t.Fatalf("error writing backup: %v", err)
+	}
+
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"), Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.Restore(&snapshot)
+	if err != nil {
+		t.Fatalf("error restoring backup: %v", err)
+	}
+
+	chirp, err := db.CreateChirp("after restore", user.Id)
+	if err != nil || chirp.Id <= purged.Id {
+		t.Errorf("CreateChirp after restore, got id: %d, %v, want one above %d", chirp.Id, err, purged.Id)
+	}
+}
+
+func TestSQLiteDBReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+
+	_, err := NewSQLiteDB(path, Options{ReadOnly: true})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a missing database read-only, got: %v, want: %v", err, fs.ErrNotExist)
+	}
+	if _, statErr := os.Stat(path); !errors.Is(statErr, fs.ErrNotExist) {
+		t.Errorf("opening a missing database read-only created %s", path)
+	}
+
+	db, err := NewSQLiteDB(path, Options{})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	user, _ := db.CreateUser("user@example.com", "hash")
+	db.CreateChirp("hello", user.Id)
+	db.Close()
+
+	readOnly, err := NewSQLiteDB(path, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("error opening database read-only: %v", err)
+	}
+	defer readOnly.Close()
+
+	var snapshot bytes.Buffer
+	err = readOnly.Backup(&snapshot)
+	if err != nil {
+		t.Errorf("error backing up a read-only database: %v", err)
+	}
+
+	chirps, err := readOnly.ListChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 1 {
+		t.Errorf("ListChirps read-only, got: %+v, %v, want one chirp", chirps, err)
+	}
+
+	_, err = readOnly.CreateChirp("rejected", user.Id)
+	if err == nil {
+		t.Error("CreateChirp on a read-only database, got no error")
+	}
+}
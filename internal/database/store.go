@@ -0,0 +1,75 @@
+package database
+
+import (
+	"io"
+	"time"
+)
+
+// HandlerStore is what the API handlers need: chirps, users and the tokens
+// that authenticate them. It is small enough for handler tests to fake.
+type HandlerStore interface {
+	CreateChirp(body string, authorId int) (Chirp, error)
+	ListChirps(query ChirpQuery) ([]Chirp, error)
+	GetChirpById(chirpId int) (Chirp, error)
+	DeleteChirpById(chirpId int) error
+	GetDeletedChirpById(chirpId int) (Chirp, error)
+	RestoreChirpById(chirpId int) (Chirp, error)
+
+	CreateUser(email, passwordHash string) (User, error)
+	GetUserById(userId int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	UpdateUserEmailPasswordById(userId int, email, passwordHash string) (User, error)
+	UpgradeUserToRedByUserId(userId int) error
+
+	CreateRefreshToken(userId int, token string, expiresAt time.Time, client Client) (RefreshToken, error)
+	DeleteRefreshToken(token string) error
+	RotateRefreshToken(token, newToken string, expiresAt time.Time, client Client) (User, RefreshToken, error)
+	RevokeRefreshTokenFamily(userId int, familyId string) error
+	RevokeSessionsByUser(userId int) (int, error)
+	IsRefreshTokenFamilyActive(userId int, familyId string) (bool, error)
+	GetUserAndRefreshTokenByRefreshToken(token string) (User, RefreshToken, error)
+	GetRefreshTokensByUser(userId int) ([]RefreshToken, error)
+
+	RevokeAccessToken(id string, expiresAt time.Time) error
+	IsAccessTokenRevoked(id string) (bool, error)
+}
+
+// AdminStore is what maintenance needs: reads of whole tables or pages of
+// them for exports and reindexing, bulk imports, purges, and backups.
+type AdminStore interface {
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(authorId int) ([]Chirp, error)
+	ListChirps(query ChirpQuery) ([]Chirp, error)
+	GetUsers() ([]User, error)
+	ListUsers(afterId, limit int) ([]User, error)
+
+	PurgeDeletedChirps(cutoff time.Time) (int, error)
+	PurgeExpiredRefreshTokens(cutoff time.Time) (int, error)
+	PurgeRevokedAccessTokens(cutoff time.Time) (int, error)
+
+	Import(users []User, chirps []Chirp, remapIds bool) error
+
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// ReplicationStore is what a primary needs to be followed and a replica to
+// follow it: a snapshot to start from and the change events after it.
+type ReplicationStore interface {
+	Subscribe(buffer int) (<-chan Event, func())
+	Apply(event Event) error
+
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// Store is a whole database, as opened by the server and the commands.
+type Store interface {
+	HandlerStore
+	AdminStore
+	ReplicationStore
+
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
@@ -2,6 +2,8 @@ package database
 
 import (
 	"errors"
+	"slices"
+	"time"
 )
 
 type User struct {
@@ -9,6 +11,11 @@ type User struct {
 	Email        string `json:"email"`
 	PasswordHash string `json:"password_hash"`
 	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	// TokenVersion is carried by access tokens, and bumping it invalidates
+	// every token issued before.
+	TokenVersion int       `json:"token_version"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 var ErrUserAlreadyExists = errors.New("User already exists")
@@ -16,138 +23,174 @@ var ErrUserDoesNotExist = errors.New("User doesn't exist")
 var ErrPasswordMismatch = errors.New("Password doesn't match")
 
 func (db *DB) CreateUser(email, passwordHash string) (User, error) {
-	dbStructure, err := db.loadDB()
+	var newUser User
 
-	if err != nil {
-		return User{}, ErrDatabaseLoad
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return User{}, ErrUserAlreadyExists
+	err := db.Update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.idx.userIdByEmail[email]; ok {
+			return ErrUserAlreadyExists
 		}
-	}
 
-	lastId := 0
-	for key := range dbStructure.Users {
-		if key > lastId {
-			lastId = key
+		now := time.Now().UTC()
+		newUser = User{
+			Id:           dbStructure.nextId(db.opts.IDGenerator, usersSequence),
+			Email:        email,
+			PasswordHash: passwordHash,
+			CreatedAt:    now,
+			UpdatedAt:    now,
 		}
-	}
 
-	nextId := lastId + 1
+		dbStructure.PutUser(newUser)
+		return nil
+	})
 
-	newUser := User{
-		Id:           nextId,
-		Email:        email,
-		PasswordHash: passwordHash,
+	if err != nil {
+		return User{}, err
 	}
 
-	dbStructure.Users[nextId] = newUser
+	return newUser, nil
+}
 
-	err = db.writeDB(dbStructure)
+func (db *DB) GetUsers() ([]User, error) {
+	var users []User
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		users = make([]User, 0, len(dbStructure.Users))
+
+		for _, user := range dbStructure.Users {
+			users = append(users, user)
+		}
+		return nil
+	})
 
 	if err != nil {
-		return User{}, ErrDatabaseWrite
+		return nil, err
 	}
 
-	return newUser, nil
+	return users, nil
 }
 
-func (db *DB) GetUserById(userId int) (User, error) {
-	dbStructure, err := db.loadDB()
+// ListUsers returns up to limit users, or every one when it's 0, in id order
+// starting just past afterId. Like ListChirps it walks an id index, so a page
+// costs its own size.
+func (db *DB) ListUsers(afterId, limit int) ([]User, error) {
+	users := []User{}
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		userIds := dbStructure.idx.userIds
+		i, ok := slices.BinarySearch(userIds, afterId)
+		if ok {
+			i++
+		}
+
+		for ; i < len(userIds); i++ {
+			if limit != 0 && len(users) == limit {
+				break
+			}
+			users = append(users, dbStructure.Users[userIds[i]])
+		}
+		return nil
+	})
 
 	if err != nil {
-		return User{}, ErrDatabaseLoad
+		return nil, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Id == userId {
-			return user, nil
-		} else {
-			return User{}, ErrUserDoesNotExist
+	return users, nil
+}
+
+func (db *DB) GetUserById(userId int) (User, error) {
+	var user User
+
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[userId]
+
+		if !ok {
+			return ErrUserDoesNotExist
 		}
+		return nil
+	})
 
+	if err != nil {
+		return User{}, err
 	}
 
-	return User{}, ErrUserDoesNotExist
+	return user, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStructure, err := db.loadDB()
+	var user User
 
-	if err != nil {
-		return User{}, ErrDatabaseLoad
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
+	err := db.View(func(dbStructure *DBStructure) error {
+		userId, ok := dbStructure.idx.userIdByEmail[email]
+		if !ok {
+			return ErrUserDoesNotExist
 		}
+
+		user = dbStructure.Users[userId]
+		return nil
+	})
+
+	if err != nil {
+		return User{}, err
 	}
 
-	return User{}, ErrUserDoesNotExist
+	return user, nil
 }
 
+// UpdateUserEmailPasswordById changes a user's email and password. A new
+// password hash bumps the user's token version and revokes their refresh
+// tokens, so no token issued under the old password keeps working; callers
+// keeping the password pass its current hash.
 func (db *DB) UpdateUserEmailPasswordById(userId int, email, passwordHash string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, ErrDatabaseLoad
-	}
+	var updatedUser User
 
-	user, ok := dbStructure.Users[userId]
+	err := db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
 
-	if !ok {
-		return User{}, ErrUserDoesNotExist
-	}
+		if !ok {
+			return ErrUserDoesNotExist
+		}
 
-	updatedUser := User{
-		Id:           user.Id,
-		Email:        email,
-		PasswordHash: passwordHash,
-	}
+		if ownerId, ok := dbStructure.idx.userIdByEmail[email]; ok && ownerId != userId {
+			return ErrUserAlreadyExists
+		}
 
-	dbStructure.Users[userId] = updatedUser
+		updatedUser = user
+		updatedUser.Email = email
+		updatedUser.PasswordHash = passwordHash
+		updatedUser.UpdatedAt = time.Now().UTC()
+		if passwordHash != user.PasswordHash {
+			updatedUser.TokenVersion++
+			dbStructure.revokeRefreshTokensByUser(userId)
+		}
 
-	err = db.writeDB(dbStructure)
+		dbStructure.PutUser(updatedUser)
+		return nil
+	})
 
 	if err != nil {
-		return User{}, ErrDatabaseWrite
+		return User{}, err
 	}
 
 	return updatedUser, nil
 }
 
 func (db *DB) UpgradeUserToRedByUserId(userId int) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return ErrDatabaseLoad
-	}
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
 
-	user, ok := dbStructure.Users[userId]
+		if !ok {
+			return ErrUserDoesNotExist
+		}
 
-	if !ok {
-		return ErrUserDoesNotExist
-	}
+		if user.IsChirpyRed {
+			return nil
+		}
 
-	if user.IsChirpyRed {
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.PutUser(user)
 		return nil
-	}
-
-	upgradedUser := User{
-		Id:           user.Id,
-		Email:        user.Email,
-		PasswordHash: user.PasswordHash,
-		IsChirpyRed:  true,
-	}
-
-	dbStructure.Users[userId] = upgradedUser
-
-	err = db.writeDB(dbStructure)
-
-	if err != nil {
-		return ErrDatabaseWrite
-	}
-
-	return nil
+	})
 }
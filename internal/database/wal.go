@@ -0,0 +1,315 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+const (
+	opPutChirp           = "put_chirp"
+	opDeleteChirp        = "delete_chirp"
+	opPutUser            = "put_user"
+	opDeleteUser         = "delete_user"
+	opPutRefreshToken    = "put_refresh_token"
+	opDeleteRefreshToken = "delete_refresh_token"
+
+	opPutRevokedAccessToken    = "put_revoked_access_token"
+	opDeleteRevokedAccessToken = "delete_revoked_access_token"
+)
+
+// logEntry is a single change to DBStructure. Each line of the write-ahead
+// log holds the entries of one Update, so a torn line never applies half of
+// a transaction.
+type logEntry struct {
+	Op           string        `json:"op"`
+	ChirpId      int           `json:"chirp_id,omitempty"`
+	Chirp        *Chirp        `json:"chirp,omitempty"`
+	UserId       int           `json:"user_id,omitempty"`
+	User         *User         `json:"user,omitempty"`
+	TokenHash    string        `json:"token_hash,omitempty"`
+	RefreshToken *RefreshToken `json:"refresh_token,omitempty"`
+
+	AccessTokenId      string              `json:"access_token_id,omitempty"`
+	RevokedAccessToken *RevokedAccessToken `json:"revoked_access_token,omitempty"`
+}
+
+type txLog struct {
+	entries []logEntry
+	undo    []logEntry
+}
+
+// The Put and Delete methods are the only way Update callers should change
+// DBStructure: they log the change and record its inverse for rollback.
+
+func (dbStructure *DBStructure) PutChirp(chirp Chirp) {
+	undo := logEntry{Op: opDeleteChirp, ChirpId: chirp.Id}
+	if prev, ok := dbStructure.Chirps[chirp.Id]; ok {
+		undo = logEntry{Op: opPutChirp, Chirp: &prev}
+	}
+	dbStructure.record(logEntry{Op: opPutChirp, Chirp: &chirp}, undo)
+}
+
+func (dbStructure *DBStructure) DeleteChirp(chirpId int) {
+	prev, ok := dbStructure.Chirps[chirpId]
+	if !ok {
+		return
+	}
+	dbStructure.record(logEntry{Op: opDeleteChirp, ChirpId: chirpId}, logEntry{Op: opPutChirp, Chirp: &prev})
+}
+
+func (dbStructure *DBStructure) PutUser(user User) {
+	undo := logEntry{Op: opDeleteUser, UserId: user.Id}
+	if prev, ok := dbStructure.Users[user.Id]; ok {
+		undo = logEntry{Op: opPutUser, User: &prev}
+	}
+	dbStructure.record(logEntry{Op: opPutUser, User: &user}, undo)
+}
+
+func (dbStructure *DBStructure) PutRefreshToken(refreshToken RefreshToken) {
+	undo := logEntry{Op: opDeleteRefreshToken, TokenHash: refreshToken.TokenHash}
+	if prev, ok := dbStructure.RefreshTokens[refreshToken.TokenHash]; ok {
+		undo = logEntry{Op: opPutRefreshToken, RefreshToken: &prev}
+	}
+	dbStructure.record(logEntry{Op: opPutRefreshToken, RefreshToken: &refreshToken}, undo)
+}
+
+func (dbStructure *DBStructure) DeleteRefreshToken(tokenHash string) {
+	prev, ok := dbStructure.RefreshTokens[tokenHash]
+	if !ok {
+		return
+	}
+	dbStructure.record(logEntry{Op: opDeleteRefreshToken, TokenHash: tokenHash}, logEntry{Op: opPutRefreshToken, RefreshToken: &prev})
+}
+
+func (dbStructure *DBStructure) PutRevokedAccessToken(revoked RevokedAccessToken) {
+	undo := logEntry{Op: opDeleteRevokedAccessToken, AccessTokenId: revoked.Id}
+	if prev, ok := dbStructure.RevokedAccessTokens[revoked.Id]; ok {
+		undo = logEntry{Op: opPutRevokedAccessToken, RevokedAccessToken: &prev}
+	}
+	dbStructure.record(logEntry{Op: opPutRevokedAccessToken, RevokedAccessToken: &revoked}, undo)
+}
+
+func (dbStructure *DBStructure) DeleteRevokedAccessToken(id string) {
+	prev, ok := dbStructure.RevokedAccessTokens[id]
+	if !ok {
+		return
+	}
+	dbStructure.record(logEntry{Op: opDeleteRevokedAccessToken, AccessTokenId: id}, logEntry{Op: opPutRevokedAccessToken, RevokedAccessToken: &prev})
+}
+
+func (dbStructure *DBStructure) record(entry, undo logEntry) {
+	dbStructure.apply(entry)
+	if dbStructure.tx != nil {
+		dbStructure.tx.entries = append(dbStructure.tx.entries, entry)
+		dbStructure.tx.undo = append(dbStructure.tx.undo, undo)
+	}
+}
+
+func (dbStructure *DBStructure) apply(entry logEntry) error {
+	idx := dbStructure.idx
+
+	switch entry.Op {
+	case opPutChirp:
+		if idx != nil {
+			prev, existed := dbStructure.Chirps[entry.Chirp.Id]
+			idx.putChirp(optional(prev, existed), *entry.Chirp)
+		}
+		dbStructure.Chirps[entry.Chirp.Id] = *entry.Chirp
+		dbStructure.advanceSequence(chirpsSequence, entry.Chirp.Id)
+	case opDeleteChirp:
+		prev, existed := dbStructure.Chirps[entry.ChirpId]
+		if idx != nil && existed {
+			idx.deleteChirp(prev)
+		}
+		delete(dbStructure.Chirps, entry.ChirpId)
+	case opPutUser:
+		if idx != nil {
+			prev, existed := dbStructure.Users[entry.User.Id]
+			idx.putUser(optional(prev, existed), *entry.User)
+		}
+		dbStructure.Users[entry.User.Id] = *entry.User
+		dbStructure.advanceSequence(usersSequence, entry.User.Id)
+	case opDeleteUser:
+		prev, existed := dbStructure.Users[entry.UserId]
+		if idx != nil && existed {
+			idx.deleteUser(prev)
+		}
+		delete(dbStructure.Users, entry.UserId)
+	case opPutRefreshToken:
+		if idx != nil {
+			prev, existed := dbStructure.RefreshTokens[entry.RefreshToken.TokenHash]
+			idx.putRefreshToken(optional(prev, existed), *entry.RefreshToken)
+		}
+		dbStructure.RefreshTokens[entry.RefreshToken.TokenHash] = *entry.RefreshToken
+	case opDeleteRefreshToken:
+		prev, existed := dbStructure.RefreshTokens[entry.TokenHash]
+		if idx != nil && existed {
+			idx.deleteRefreshToken(prev)
+		}
+		delete(dbStructure.RefreshTokens, entry.TokenHash)
+	case opPutRevokedAccessToken:
+		dbStructure.RevokedAccessTokens[entry.RevokedAccessToken.Id] = *entry.RevokedAccessToken
+	case opDeleteRevokedAccessToken:
+		delete(dbStructure.RevokedAccessTokens, entry.AccessTokenId)
+	default:
+		return fmt.Errorf("unknown log operation %q", entry.Op)
+	}
+	return nil
+}
+
+func optional[T any](value T, ok bool) *T {
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+func (dbStructure *DBStructure) begin() {
+	dbStructure.tx = &txLog{}
+}
+
+func (dbStructure *DBStructure) commit() []logEntry {
+	entries := dbStructure.tx.entries
+	dbStructure.tx = nil
+	return entries
+}
+
+func (dbStructure *DBStructure) rollback() {
+	undo := dbStructure.tx.undo
+	dbStructure.tx = nil
+	for i := len(undo) - 1; i >= 0; i-- {
+		dbStructure.apply(undo[i])
+	}
+}
+
+func (db *DB) walPath() string {
+	return db.path + ".wal"
+}
+
+// replayLog applies every complete transaction in the log to dbStructure and
+// returns how many transactions it held and the offset after the last one.
+// A torn final line is an unacknowledged write and is ignored.
+func replayLog(path string, aead cipher.AEAD, allowPlaintext bool, dbStructure *DBStructure) (int, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("problem opening %s, %v", path, err)
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	transactions := 0
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return transactions, offset, nil
+		}
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("problem reading %s, %v", path, err)
+		}
+
+		entries, err := decodeLogLine(aead, bytes.TrimSpace(line), allowPlaintext)
+		if err != nil {
+			_, peekErr := reader.Peek(1)
+			if errors.Is(peekErr, io.EOF) {
+				return transactions, offset, nil
+			}
+			if isKeyError(err) {
+				return 0, 0, err
+			}
+			return 0, 0, fmt.Errorf("%w: %s at offset %d: %v", ErrDatabaseCorrupt, path, offset, err)
+		}
+
+		for _, entry := range entries {
+			err = dbStructure.apply(entry)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%w: %s at offset %d: %v", ErrDatabaseCorrupt, path, offset, err)
+			}
+		}
+
+		transactions++
+		offset += int64(len(line))
+	}
+}
+
+func (db *DB) appendLog(entries []logEntry) error {
+	line, err := encodeLogLine(db.aead, entries)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.wal.Write(line)
+	if err == nil {
+		err = db.wal.Sync()
+	}
+
+	if err != nil {
+		// Drop whatever part of the line made it to disk so replay never sees it.
+		db.wal.Truncate(db.walSize)
+		return fmt.Errorf("problem appending to %s, %v", db.walPath(), err)
+	}
+
+	db.walSize += int64(len(line))
+	db.walTransactions++
+	return nil
+}
+
+// Log lines are JSON arrays of entries, or base64 of the sealed array when
+// the database is encrypted.
+func encodeLogLine(aead cipher.AEAD, entries []logEntry) ([]byte, error) {
+	line, err := json.Marshal(entries)
+	if err != nil {
+		return nil, fmt.Errorf("problem encoding log entry, %v", err)
+	}
+
+	if aead != nil {
+		sealed, err := seal(aead, line)
+		if err != nil {
+			return nil, err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	return append(line, '\n'), nil
+}
+
+func decodeLogLine(aead cipher.AEAD, line []byte, allowPlaintext bool) ([]logEntry, error) {
+	if bytes.HasPrefix(line, []byte("[")) {
+		if aead != nil && !allowPlaintext {
+			return nil, ErrDatabaseNotEncrypted
+		}
+	} else {
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, err
+		}
+
+		line, err = unseal(aead, sealed, allowPlaintext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []logEntry
+	err := json.Unmarshal(line, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
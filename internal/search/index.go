@@ -0,0 +1,234 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// BM25 tuning: k1 limits how much repeating a term raises a score, and b how
+// strongly long documents are penalised.
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+type Document struct {
+	Id       int
+	AuthorId int
+	Body     string
+}
+
+type Result struct {
+	Id    int
+	Score float64
+}
+
+type Options struct {
+	// AuthorId limits results to one author when it isn't 0.
+	AuthorId int
+	Offset   int
+	// Limit caps the number of results, or returns every match when it's 0.
+	Limit int
+}
+
+type document struct {
+	authorId int
+	length   int
+	// terms are the document's distinct tokens, which is where its
+	// postings live.
+	terms []string
+}
+
+// Index is an inverted index from terms to the positions they appear at in
+// each document. It is safe for concurrent use.
+type Index struct {
+	mu          sync.RWMutex
+	docs        map[int]document
+	postings    map[string]map[int][]int
+	totalLength int
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:     map[int]document{},
+		postings: map[string]map[int][]int{},
+	}
+}
+
+// Add indexes doc, replacing any earlier version with the same id.
+func (idx *Index) Add(doc Document) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(doc.Id)
+	idx.add(doc)
+}
+
+func (idx *Index) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(id)
+}
+
+// Reset replaces everything in the index with docs.
+func (idx *Index) Reset(docs []Document) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.docs = make(map[int]document, len(docs))
+	idx.postings = map[string]map[int][]int{}
+	idx.totalLength = 0
+
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+}
+
+// Len reports how many documents are indexed.
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.docs)
+}
+
+func (idx *Index) add(doc Document) {
+	tokens := Tokenize(doc.Body)
+	terms := []string{}
+
+	for position, token := range tokens {
+		positions, ok := idx.postings[token]
+		if !ok {
+			positions = map[int][]int{}
+			idx.postings[token] = positions
+		}
+		if _, ok := positions[doc.Id]; !ok {
+			terms = append(terms, token)
+		}
+		positions[doc.Id] = append(positions[doc.Id], position)
+	}
+
+	idx.docs[doc.Id] = document{authorId: doc.AuthorId, length: len(tokens), terms: terms}
+	idx.totalLength += len(tokens)
+}
+
+func (idx *Index) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+
+	for _, token := range doc.terms {
+		positions := idx.postings[token]
+		delete(positions, id)
+		if len(positions) == 0 {
+			delete(idx.postings, token)
+		}
+	}
+
+	delete(idx.docs, id)
+	idx.totalLength -= doc.length
+}
+
+// Search returns the documents matching every term and phrase in query,
+// best first, and the total number of matches before opts.Offset and
+// opts.Limit are applied. Equal scores rank newer (higher) ids first.
+func (idx *Index) Search(query Query, opts Options) ([]Result, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	terms := query.terms()
+	if len(terms) == 0 {
+		return []Result{}, 0
+	}
+
+	// Start from the rarest term so the candidate set is as small as it
+	// gets.
+	sort.Slice(terms, func(i, j int) bool {
+		return len(idx.postings[terms[i]]) < len(idx.postings[terms[j]])
+	})
+
+	results := []Result{}
+	for id := range idx.postings[terms[0]] {
+		if opts.AuthorId != 0 && idx.docs[id].authorId != opts.AuthorId {
+			continue
+		}
+		if !idx.matches(id, query, terms) {
+			continue
+		}
+		results = append(results, Result{Id: id, Score: idx.score(id, terms)})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id > results[j].Id
+	})
+
+	total := len(results)
+	if opts.Offset >= total {
+		return []Result{}, total
+	}
+	results = results[opts.Offset:]
+	if opts.Limit != 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results, total
+}
+
+func (idx *Index) matches(id int, query Query, terms []string) bool {
+	for _, term := range terms {
+		if _, ok := idx.postings[term][id]; !ok {
+			return false
+		}
+	}
+
+	for _, phrase := range query.Phrases {
+		if !idx.containsPhrase(id, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsPhrase reports whether the tokens of phrase appear one after
+// another somewhere in the document with id.
+func (idx *Index) containsPhrase(id int, phrase []string) bool {
+	for _, start := range idx.postings[phrase[0]][id] {
+		found := true
+		for offset, token := range phrase[1:] {
+			if !containsInt(idx.postings[token][id], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *Index) score(id int, terms []string) float64 {
+	docs := float64(len(idx.docs))
+	averageLength := float64(idx.totalLength) / docs
+	length := float64(idx.docs[id].length)
+
+	score := 0.0
+	for _, term := range terms {
+		matching := float64(len(idx.postings[term]))
+		frequency := float64(len(idx.postings[term][id]))
+
+		idf := math.Log(1 + (docs-matching+0.5)/(matching+0.5))
+		score += idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*length/averageLength))
+	}
+	return score
+}
+
+func containsInt(sorted []int, value int) bool {
+	i := sort.SearchInts(sorted, value)
+	return i < len(sorted) && sorted[i] == value
+}
@@ -0,0 +1,98 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestIndex() *Index {
+	idx := NewIndex()
+	idx.Reset([]Document{
+		{Id: 1, AuthorId: 1, Body: "The big red dog"},
+		{Id: 2, AuthorId: 2, Body: "A red, RED balloon"},
+		{Id: 3, AuthorId: 1, Body: "red big balloon"},
+		{Id: 4, AuthorId: 2, Body: "Nothing to see here"},
+	})
+	return idx
+}
+
+func ids(results []Result) []int {
+	got := []int{}
+	for _, result := range results {
+		got = append(got, result.Id)
+	}
+	return got
+}
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Hello, WORLD! it's 2024 — ¡Olé!")
+	want := []string{"hello", "world", "it", "s", "2024", "olé"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize, got: %q, want: %q", got, want)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	got := ParseQuery(`Red "big  Dog" "cat" "open ended`)
+	want := Query{
+		Terms:   []string{"red", "cat"},
+		Phrases: [][]string{{"big", "dog"}, {"open", "ended"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseQuery, got: %+v, want: %+v", got, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	idx := newTestIndex()
+
+	tests := []struct {
+		name  string
+		query string
+		opts  Options
+		want  []int
+		total int
+	}{
+		{name: "folds case", query: "RED", want: []int{2, 3, 1}, total: 3},
+		{name: "requires every term", query: "red balloon", want: []int{2, 3}, total: 2},
+		{name: "matches a phrase in order", query: `"big red"`, want: []int{1}, total: 1},
+		{name: "rejects a phrase out of order", query: `"balloon red"`, want: []int{}, total: 0},
+		{name: "filters by author", query: "red", opts: Options{AuthorId: 1}, want: []int{3, 1}, total: 2},
+		{name: "pages results", query: "red", opts: Options{Offset: 1, Limit: 1}, want: []int{3}, total: 3},
+		{name: "pages past the end", query: "red", opts: Options{Offset: 5}, want: []int{}, total: 3},
+		{name: "finds nothing for an unknown term", query: "cat", want: []int{}, total: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, total := idx.Search(ParseQuery(tt.query), tt.opts)
+
+			if got := ids(results); !reflect.DeepEqual(got, tt.want) || total != tt.total {
+				t.Errorf("Search(%q), got: %v of %d, want: %v of %d", tt.query, got, total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+func TestIndexAddRemove(t *testing.T) {
+	idx := newTestIndex()
+
+	idx.Add(Document{Id: 1, AuthorId: 1, Body: "a green dog"})
+	idx.Remove(3)
+
+	results, _ := idx.Search(ParseQuery("red"), Options{})
+	if got := ids(results); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("Search after update, got: %v, want: [2]", got)
+	}
+
+	results, _ = idx.Search(ParseQuery("green"), Options{})
+	if got := ids(results); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("Search for replaced body, got: %v, want: [1]", got)
+	}
+
+	if idx.Len() != 3 {
+		t.Errorf("Len, got: %d, want: 3", idx.Len())
+	}
+}
@@ -0,0 +1,69 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits text into lowercase runs of letters and digits, so
+// punctuation and case never keep a chirp from matching.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Query is a parsed search. A document matches when it contains every term
+// and every phrase.
+type Query struct {
+	Terms []string
+	// Phrases are runs of tokens that must appear consecutively.
+	Phrases [][]string
+}
+
+// ParseQuery reads a search such as `red "big cat"`: double quotes make a
+// phrase, and everything else is a term. An unterminated quote runs to the
+// end of q.
+func ParseQuery(q string) Query {
+	query := Query{Terms: []string{}, Phrases: [][]string{}}
+
+	for i, part := range strings.Split(q, `"`) {
+		tokens := Tokenize(part)
+
+		// Parts at odd indexes sit between a pair of quotes. A phrase of
+		// one token is just a term.
+		if i%2 == 1 && len(tokens) > 1 {
+			query.Phrases = append(query.Phrases, tokens)
+			continue
+		}
+		query.Terms = append(query.Terms, tokens...)
+	}
+
+	return query
+}
+
+func (query Query) IsEmpty() bool {
+	return len(query.Terms) == 0 && len(query.Phrases) == 0
+}
+
+// terms returns every distinct token the query needs, including those inside
+// phrases.
+func (query Query) terms() []string {
+	seen := map[string]bool{}
+	terms := []string{}
+
+	add := func(tokens []string) {
+		for _, token := range tokens {
+			if !seen[token] {
+				seen[token] = true
+				terms = append(terms, token)
+			}
+		}
+	}
+
+	add(query.Terms)
+	for _, phrase := range query.Phrases {
+		add(phrase)
+	}
+	return terms
+}
@@ -1,35 +1,234 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/iamhectorsosa/web-server/internal/auth"
 	"github.com/iamhectorsosa/web-server/internal/database"
 	"github.com/joho/godotenv"
 )
 
-const port = "8080"
+const defaultPort = "8080"
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		// Commands also run where no .env file exists, such as during restores.
+		godotenv.Load()
+
+		err := runCommand(os.Args[1], os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaApiKey := os.Getenv("POLKA_API_KEY")
+	adminApiKey := os.Getenv("ADMIN_API_KEY")
 
+	port := flag.String("port", defaultPort, "Port to listen on. A replica on the same host needs its own.")
 	dbg := flag.Bool("debug", false, "Enable debug mode and get a fresh database to start with.")
+	dbDriver := flag.String("db-driver", "json", "Database driver to use: json or sqlite.")
+	dbPath := flag.String("db", "", "Path to the database. Defaults to database.json or database.db depending on the driver.")
+	compactInterval := flag.Duration("compact-interval", 0, "How often the JSON database folds its write-ahead log into database.json. Defaults to 5m.")
+	backupDir := flag.String("backup-dir", defaultBackupDir, "Directory where POST /admin/backup writes snapshots.")
+	idGenerator := flag.String("id-generator", "sequence", "How new chirp and user ids are issued: sequence or snowflake.")
+	chirpRestoreWindow := flag.Duration("chirp-restore-window", defaultChirpRestoreWindow, "How long after deletion an author may restore a chirp.")
+	chirpRetention := flag.Duration("chirp-retention", defaultChirpRetention, "How long deleted chirps are kept before being purged for good.")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "How often deleted chirps past their retention, expired refresh tokens and expired entries of the access token denylist are purged.")
+	replicaOf := flag.String("replica-of", "", "URL of a primary to follow as a read-only replica, such as http://localhost:8080.")
+	nodeId := flag.Int("node-id", 0, "Node id (0-15) embedded in snowflake ids. Instances sharing a database need distinct ids.")
 	flag.Parse()
 
-	databaseStore, err := database.NewDB("database.json", *dbg)
+	jwtKeys, err := jwtKeyringFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Debug = *dbg
+	opts.CompactInterval = *compactInterval
+	opts.IDGenerator, err = newIDGenerator(*idGenerator, *nodeId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	databaseStore, err := openStore(*dbDriver, *dbPath, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	api := apiConfig{
+		DB:          databaseStore,
+		admin:       databaseStore,
+		replication: databaseStore,
+		jwtKeys:     jwtKeys,
+		polkaApiKey: polkaApiKey,
+		adminApiKey: adminApiKey,
+		backupDir:   *backupDir,
+
+		chirpRestoreWindow: *chirpRestoreWindow,
+		replicaOf:          *replicaOf,
+		search:             newSearchIndexer(databaseStore),
+	}
+	server := NewServer(api, *port)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Long-lived requests such as replication streams end on shutdown
+	// instead of holding it up.
+	server.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	// A replica only changes by following its primary, which purges for it.
+	backgroundDone := make(chan struct{})
+	go func() {
+		defer close(backgroundDone)
+		if *replicaOf != "" {
+			primaryApiKey := os.Getenv("PRIMARY_API_KEY")
+			if primaryApiKey == "" {
+				primaryApiKey = adminApiKey
+			}
+			followPrimary(ctx, databaseStore, *replicaOf, primaryApiKey)
+		} else {
+			runPurges(ctx, databaseStore, *chirpRetention, *purgeInterval)
+		}
+	}()
+
+	searchDone := make(chan struct{})
+	go func() {
+		defer close(searchDone)
+		api.search.run(ctx)
+	}()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Listening on port: http://localhost:%s\n", *port)
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	<-backgroundDone
+	<-searchDone
+
+	err = databaseStore.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+func newIDGenerator(name string, nodeId int) (database.IDGenerator, error) {
+	switch name {
+	case "sequence":
+		return database.SequenceGenerator{}, nil
+	case "snowflake":
+		if nodeId < 0 || nodeId > database.SnowflakeMaxNode {
+			return nil, fmt.Errorf("node id %d out of range 0-%d", nodeId, database.SnowflakeMaxNode)
+		}
+		return &database.SnowflakeGenerator{Node: nodeId}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator %q", name)
+	}
+}
+
+// openStore opens the store for driver at path, or at the driver's default
+// path when path is empty.
+func openStore(driver, path string, opts database.Options) (database.Store, error) {
+	switch driver {
+	case "json":
+		if path == "" {
+			path = defaultJSONDatabasePath
+		}
+		return database.Open(path, opts)
+	case "sqlite":
+		if path == "" {
+			path = defaultSQLiteDatabasePath
+		}
+		if len(opts.EncryptionKey) > 0 {
+			return nil, fmt.Errorf("DB_ENCRYPTION_KEY is only supported by the json driver")
+		}
+		return database.NewSQLiteDB(path, opts)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// jwtSecretKeyId names the JWT_SECRET key in kid headers.
+const jwtSecretKeyId = "jwt-secret"
+
+// jwtKeyringFromEnv builds the keys access tokens are signed and verified
+// with. JWT_SIGNING_KEY_FILE names a PEM RSA or Ed25519 private key to sign
+// with, and JWT_VERIFICATION_KEY_FILES a comma separated list of PEM keys
+// still accepted, such as the one it replaced. Without a signing key
+// JWT_SECRET signs, and with one it keeps verifying the tokens it signed.
+func jwtKeyringFromEnv() (*auth.Keyring, error) {
+	secret := os.Getenv("JWT_SECRET")
+
+	verifying := []auth.Key{}
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEY_FILES"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		key, err := readJWTKey(path)
+		if err != nil {
+			return nil, err
+		}
+		verifying = append(verifying, key)
+	}
 
-	api := apiConfig{DB: databaseStore, jwtSecret: jwtSecret, polkaApiKey: polkaApiKey}
-	server := NewServer(api, port)
-	log.Printf("Listening on port: http://localhost:%s\n", port)
-	log.Fatal(server.ListenAndServe())
+	signingKeyFile := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if signingKeyFile == "" {
+		return auth.NewKeyring(auth.NewHMACKey(jwtSecretKeyId, []byte(secret)), verifying...)
+	}
+
+	signing, err := readJWTKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret != "" {
+		verifying = append(verifying, auth.NewHMACKey(jwtSecretKeyId, []byte(secret)))
+	}
+	return auth.NewKeyring(signing, verifying...)
+}
+
+func readJWTKey(path string) (auth.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return auth.Key{}, fmt.Errorf("problem reading JWT key %s, %v", path, err)
+	}
+
+	key, err := auth.ParseKey("", data)
+	if err != nil {
+		return auth.Key{}, fmt.Errorf("problem parsing JWT key %s, %v", path, err)
+	}
+	return key, nil
 }
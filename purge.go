@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const (
+	defaultChirpRestoreWindow = 24 * time.Hour
+	defaultChirpRetention     = 30 * 24 * time.Hour
+)
+
+// runPurges removes data that has outlived its use every interval until ctx
+// is done: chirps soft-deleted for longer than retention, expired refresh
+// tokens, and denylist entries for revoked access tokens that have since
+// expired.
+func runPurges(ctx context.Context, store database.AdminStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			logPurge("deleted chirps", func() (int, error) {
+				return store.PurgeDeletedChirps(now.Add(-retention))
+			})
+			logPurge("expired refresh tokens", func() (int, error) {
+				return store.PurgeExpiredRefreshTokens(now)
+			})
+			logPurge("expired access tokens from the denylist", func() (int, error) {
+				return store.PurgeRevokedAccessTokens(now)
+			})
+		}
+	}
+}
+
+// logPurge runs purge and logs what it removed. A failed purge is retried on
+// the next tick and doesn't hold up the others.
+func logPurge(what string, purge func() (int, error)) {
+	purged, err := purge()
+	if err != nil {
+		log.Printf("Error purging %s: %v", what, err)
+		return
+	}
+	if purged > 0 {
+		log.Printf("Purged %d %s", purged, what)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const (
+	replicationBuffer = 1024
+	replicaRetryDelay = time.Second
+)
+
+// replicationMessage is one line of the GET /admin/replication stream. The
+// first line carries a snapshot in backup format; every later line carries
+// an event published after the snapshot's subscription began.
+type replicationMessage struct {
+	Snapshot []byte          `json:"snapshot,omitempty"`
+	Event    *database.Event `json:"event,omitempty"`
+}
+
+// followPrimary keeps store in step with the primary at primaryURL until ctx
+// is done, resyncing from a fresh snapshot whenever the stream breaks.
+func followPrimary(ctx context.Context, store database.ReplicationStore, primaryURL, apiKey string) {
+	for {
+		err := syncFromPrimary(ctx, store, primaryURL, apiKey)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Replication from %s interrupted: %v", primaryURL, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+func syncFromPrimary(ctx context.Context, store database.ReplicationStore, primaryURL, apiKey string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(primaryURL, "/")+"/admin/replication", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "ApiKey "+apiKey)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded %s", response.Status)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message replicationMessage
+		err = decoder.Decode(&message)
+		if errors.Is(err, io.EOF) {
+			return errors.New("primary closed the stream")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case message.Snapshot != nil:
+			err = store.Restore(bytes.NewReader(message.Snapshot))
+		case message.Event != nil:
+			err = store.Apply(*message.Event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writable rejects requests on a replica, whose data only changes by
+// following the primary.
+func (api *apiConfig) writable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.replicaOf != "" {
+			respondWithError(w, http.StatusServiceUnavailable, "Read-only replica")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+const testAdminApiKey = "test-admin-key"
+
+// TestReplicaFollowsPrimary builds the server and runs a primary and a
+// replica as separate processes, the way they run in production.
+func TestReplicaFollowsPrimary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the server")
+	}
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "server")
+	output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("error building the server: %v\n%s", err, output)
+	}
+
+	env := "JWT_SECRET=test-secret\nADMIN_API_KEY=" + testAdminApiKey + "\nPOLKA_API_KEY=test-polka-key\n"
+	err = os.WriteFile(filepath.Join(dir, ".env"), []byte(env), 0600)
+	if err != nil {
+		t.Fatalf("error writing .env: %v", err)
+	}
+
+	primary := startServer(t, dir, binary, "-db", filepath.Join(dir, "primary.json"))
+	replica := startServer(t, dir, binary, "-db", filepath.Join(dir, "replica.json"), "-replica-of", primary)
+
+	serve := func(method, url, token, body string) *http.Response {
+		t.Helper()
+
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		t.Cleanup(func() { response.Body.Close() })
+		return response
+	}
+
+	credentials := `{"email":"user@example.com","password":"password"}`
+	AssertResponseCode(t, serve(http.MethodPost, primary+"/api/users", "", credentials).StatusCode, http.StatusCreated)
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(serve(http.MethodPost, primary+"/api/login", "", credentials).Body).Decode(&login)
+
+	var chirp database.Chirp
+	response := serve(http.MethodPost, primary+"/api/chirps", login.Token, `{"body":"written on the primary"}`)
+	AssertResponseCode(t, response.StatusCode, http.StatusCreated)
+	json.NewDecoder(response.Body).Decode(&chirp)
+
+	chirpURL := fmt.Sprintf("%s/api/chirps/%d", replica, chirp.Id)
+	replicaStatus := func() int {
+		response, err := http.Get(chirpURL)
+		if err != nil {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	waitFor(t, func() bool { return replicaStatus() == http.StatusOK })
+
+	AssertResponseCode(t, serve(http.MethodDelete, fmt.Sprintf("%s/api/chirps/%d", primary, chirp.Id), login.Token, "").StatusCode, http.StatusNoContent)
+	waitFor(t, func() bool { return replicaStatus() == http.StatusNotFound })
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		statusCode int
+	}{
+		{name: "serves reads", method: http.MethodGet, target: "/api/chirps", statusCode: http.StatusOK},
+		{name: "rejects new chirps", method: http.MethodPost, target: "/api/chirps", statusCode: http.StatusServiceUnavailable},
+		{name: "rejects new users", method: http.MethodPost, target: "/api/users", statusCode: http.StatusServiceUnavailable},
+		{name: "rejects logins", method: http.MethodPost, target: "/api/login", statusCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertResponseCode(t, serve(tt.method, replica+tt.target, login.Token, credentials).StatusCode, tt.statusCode)
+		})
+	}
+}
+
+// startServer runs binary from dir on a free port with args, waits until it
+// serves requests and returns its URL. The server is interrupted when the
+// test ends.
+func startServer(t *testing.T, dir, binary string, args ...string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error finding a free port: %v", err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	var output bytes.Buffer
+	cmd := exec.Command(binary, append([]string{"-port", port}, args...)...)
+	cmd.Dir = dir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting the server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		err := cmd.Wait()
+		if err != nil {
+			t.Errorf("server on port %s exited with %v:\n%s", port, err, output.String())
+		}
+	})
+
+	url := "http://localhost:" + port
+	waitFor(t, func() bool {
+		response, err := http.Get(url + "/api/chirps")
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return true
+	})
+	return url
+}
+
+func TestReplicationRequiresApiKey(t *testing.T) {
+	api := apiConfig{DB: newTestStore(t), adminApiKey: testAdminApiKey}
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/replication", nil)
+	request.Header.Set("Authorization", "ApiKey wrong")
+	response := httptest.NewRecorder()
+	api.getReplication(response, request)
+
+	AssertResponseCode(t, response.Code, http.StatusUnauthorized)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the replica")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+	"github.com/iamhectorsosa/web-server/internal/search"
+)
+
+const (
+	searchIndexBuffer = 1024
+	searchRetryDelay  = time.Second
+)
+
+// searchIndexer keeps a search index of live chirps in step with a store.
+type searchIndexer struct {
+	store   database.Store
+	index   *search.Index
+	reindex chan chan error
+}
+
+func newSearchIndexer(store database.Store) *searchIndexer {
+	return &searchIndexer{
+		store:   store,
+		index:   search.NewIndex(),
+		reindex: make(chan chan error),
+	}
+}
+
+// run builds the index from the store and then applies every change event
+// until ctx is done. A dropped subscription, a restored database or a
+// Reindex call rebuilds it from scratch.
+func (s *searchIndexer) run(ctx context.Context) {
+	var reply chan error
+
+	for {
+		// Subscribing before reading the chirps means no change falls
+		// between the two; changes already read are applied harmlessly.
+		events, unsubscribe := s.store.Subscribe(searchIndexBuffer)
+		err := s.rebuild()
+		if reply != nil {
+			reply <- err
+			reply = nil
+		}
+
+		if err != nil {
+			unsubscribe()
+			log.Printf("Error building search index: %v", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case reply = <-s.reindex:
+			case <-time.After(searchRetryDelay):
+			}
+			continue
+		}
+
+		reply = s.follow(ctx, events)
+		unsubscribe()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// follow applies events to the index until the stream has to be rebuilt, and
+// returns the reply channel of a Reindex call if that's the reason.
+func (s *searchIndexer) follow(ctx context.Context, events <-chan database.Event) chan error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case reply := <-s.reindex:
+			return reply
+		case event, ok := <-events:
+			if !ok || event.Type == database.DatabaseRestored {
+				return nil
+			}
+			s.apply(event)
+		}
+	}
+}
+
+func (s *searchIndexer) apply(event database.Event) {
+	chirp := event.Chirp
+	if chirp == nil {
+		return
+	}
+
+	if event.Type == database.ChirpPurged || chirp.DeletedAt != nil {
+		s.index.Remove(chirp.Id)
+		return
+	}
+	s.index.Add(searchDocument(*chirp))
+}
+
+func (s *searchIndexer) rebuild() error {
+	chirps, err := s.store.GetChirps()
+	if err != nil {
+		return err
+	}
+
+	docs := make([]search.Document, 0, len(chirps))
+	for _, chirp := range chirps {
+		docs = append(docs, searchDocument(chirp))
+	}
+
+	s.index.Reset(docs)
+	return nil
+}
+
+// Reindex asks run to rebuild the index from the store and waits for it.
+func (s *searchIndexer) Reindex(ctx context.Context) error {
+	reply := make(chan error, 1)
+
+	select {
+	case s.reindex <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func searchDocument(chirp database.Chirp) search.Document {
+	return search.Document{Id: chirp.Id, AuthorId: chirp.AuthorId, Body: chirp.Body}
+}
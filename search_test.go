@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+	"github.com/iamhectorsosa/web-server/internal/search"
+)
+
+func searchIds(indexer *searchIndexer, q string) []int {
+	results, _ := indexer.index.Search(search.ParseQuery(q), search.Options{})
+
+	ids := []int{}
+	for _, result := range results {
+		ids = append(ids, result.Id)
+	}
+	return ids
+}
+
+func TestSearchIndexerFollowsStore(t *testing.T) {
+	store, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer store.Close()
+
+	user, _ := store.CreateUser("user@example.com", "hash")
+	before, _ := store.CreateChirp("indexed on start", user.Id)
+
+	indexer := newSearchIndexer(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		indexer.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, func() bool { return len(searchIds(indexer, "start")) == 1 })
+
+	after, _ := store.CreateChirp("indexed on create", user.Id)
+	waitFor(t, func() bool { return len(searchIds(indexer, "create")) == 1 })
+
+	store.DeleteChirpById(before.Id)
+	waitFor(t, func() bool { return len(searchIds(indexer, "start")) == 0 })
+
+	store.RestoreChirpById(before.Id)
+	waitFor(t, func() bool { return len(searchIds(indexer, "indexed")) == 2 })
+
+	server := NewServer(apiConfig{DB: store, adminApiKey: testAdminApiKey, search: indexer}, "").Handler
+	request := httptest.NewRequest(http.MethodPost, "/admin/search/reindex", nil)
+	request.Header.Set("Authorization", "ApiKey "+testAdminApiKey)
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	AssertResponseCode(t, response.Code, http.StatusOK)
+	AssertResponseBody(t, response.Body.String(), "{\"chirps\":2}")
+	AssertResponseBody(t, searchIds(indexer, "indexed"), []int{after.Id, before.Id})
+}
+
+func TestGetChirpsSearch(t *testing.T) {
+	store := newTestStore(t)
+	store.CreateChirp("The big red dog", 1)
+	store.CreateChirp("A red, RED balloon", 2)
+	store.CreateChirp("red big balloon", 1)
+	store.CreateChirp("a red herring", 2)
+	store.DeleteChirpById(4)
+
+	api := apiConfig{DB: store, search: newSearchIndexer(store)}
+
+	// Index chirp 4 as if its deletion hadn't reached the index yet.
+	api.search.rebuild()
+	api.search.index.Add(search.Document{Id: 4, AuthorId: 2, Body: "a red herring"})
+
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+		want       []int
+		link       string
+	}{
+		{name: "ranks matches", query: "?q=red", statusCode: http.StatusOK, want: []int{2, 3, 1}},
+		{name: "matches a phrase", query: `?q="big+red"`, statusCode: http.StatusOK, want: []int{1}},
+		{name: "filters by author", query: "?q=red&author_id=1", statusCode: http.StatusOK, want: []int{3, 1}},
+		// Chirp 4 ranks second, and skipping it leaves the page short.
+		{name: "links the next page", query: "?q=red&limit=2", statusCode: http.StatusOK, want: []int{2}, link: `</api/chirps/search?cursor=eyJvZmZzZXQiOjJ9&limit=2&q=red>; rel="next"`},
+		{name: "reads the next page", query: "?q=red&limit=2&cursor=eyJvZmZzZXQiOjJ9", statusCode: http.StatusOK, want: []int{3, 1}},
+		{name: "rejects an empty query", query: "?q=+", statusCode: http.StatusBadRequest},
+		{name: "rejects an invalid cursor", query: "?q=red&cursor=bad", statusCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/chirps/search"+tt.query, nil)
+			response := httptest.NewRecorder()
+			api.getChirpsSearch(response, request)
+
+			AssertResponseCode(t, response.Code, tt.statusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var chirps []database.Chirp
+			err := json.NewDecoder(response.Body).Decode(&chirps)
+			if err != nil {
+				t.Fatalf("error decoding JSON response: %v", err)
+			}
+
+			got := []int{}
+			for _, chirp := range chirps {
+				got = append(got, chirp.Id)
+			}
+
+			AssertResponseBody(t, got, tt.want)
+			AssertResponseHeader(t, response.Header().Get("Link"), tt.link)
+		})
+	}
+}
@@ -1,32 +1,97 @@
 package main
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/iamhectorsosa/web-server/internal/auth"
 	"github.com/iamhectorsosa/web-server/internal/database"
 )
 
 type apiConfig struct {
-	DB          *database.DB
-	jwtSecret   string
+	DB database.HandlerStore
+	// admin and replication serve the admin endpoints.
+	admin       database.AdminStore
+	replication database.ReplicationStore
+	jwtKeys     *auth.Keyring
 	polkaApiKey string
+	adminApiKey string
+	backupDir   string
+	// chirpRestoreWindow is how long after deletion an author may restore
+	// a chirp.
+	chirpRestoreWindow time.Duration
+	// replicaOf is the primary's URL when this instance is a read-only
+	// replica.
+	replicaOf string
+	search    *searchIndexer
+}
+
+// tokenRevocations lets auth.ValidateJWT check access tokens against the
+// store.
+type tokenRevocations struct {
+	database.HandlerStore
+}
+
+func (revocations tokenRevocations) IsSessionActive(userId int, sessionId string) (bool, error) {
+	return revocations.IsRefreshTokenFamilyActive(userId, sessionId)
+}
+
+func (revocations tokenRevocations) GetTokenVersion(userId int) (int, error) {
+	user, err := revocations.GetUserById(userId)
+	if err == database.ErrUserDoesNotExist {
+		return 0, auth.ErrJWTRevoked
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return user.TokenVersion, nil
+}
+
+// respondWithJWTError answers a request whose access token didn't validate.
+// Failing to look revocations up is the server's fault, so it doesn't sign
+// the client out.
+func respondWithJWTError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrRevocationLookup) {
+		log.Printf("Error validating access token: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't validate access token")
+		return
+	}
+
+	respondWithError(w, http.StatusUnauthorized, "Unauthenticated request")
 }
 
 func NewServer(api apiConfig, port string) *http.Server {
 	router := http.NewServeMux()
 	router.HandleFunc("GET /api/chirps", api.getChirps)
+	router.HandleFunc("GET /api/chirps/search", api.getChirpsSearch)
 	router.HandleFunc("GET /api/chirps/{id}", api.getChirpById)
-	router.HandleFunc("POST /api/chirps", api.postChirps)
-	router.HandleFunc("DELETE /api/chirps/{id}", api.deleteChirpById)
+	router.HandleFunc("POST /api/chirps", api.writable(api.postChirps))
+	router.HandleFunc("DELETE /api/chirps/{id}", api.writable(api.deleteChirpById))
+	router.HandleFunc("POST /api/chirps/{id}/restore", api.writable(api.postChirpRestore))
+
+	router.HandleFunc("POST /api/users", api.writable(api.postUsers))
+	router.HandleFunc("PUT /api/users", api.writable(api.putUsers))
+	router.HandleFunc("POST /api/login", api.writable(api.postLogin))
+
+	router.HandleFunc("POST /api/refresh", api.writable(api.postRefresh))
+	router.HandleFunc("POST /api/revoke", api.writable(api.postRevoke))
+	router.HandleFunc("POST /api/logout", api.writable(api.postLogout))
+
+	router.HandleFunc("GET /api/sessions", api.getSessions)
+	router.HandleFunc("DELETE /api/sessions/{id}", api.writable(api.deleteSession))
+	router.HandleFunc("POST /api/sessions/revoke-all", api.writable(api.postSessionsRevokeAll))
 
-	router.HandleFunc("POST /api/users", api.postUsers)
-	router.HandleFunc("PUT /api/users", api.putUsers)
-	router.HandleFunc("POST /api/login", api.postLogin)
+	router.HandleFunc("GET /.well-known/jwks.json", api.getJWKS)
 
-	router.HandleFunc("POST /api/refresh", api.postRefresh)
-	router.HandleFunc("POST /api/revoke", api.postRevoke)
+	router.HandleFunc("POST /api/polka/webhooks", api.writable(api.postUserUpgrade))
 
-	router.HandleFunc("POST /api/polka/webhooks", api.postUserUpgrade)
+	router.HandleFunc("POST /admin/backup", api.postBackup)
+	router.HandleFunc("GET /admin/backup", api.getBackup)
+	router.HandleFunc("GET /admin/replication", api.getReplication)
+	router.HandleFunc("POST /admin/search/reindex", api.postSearchReindex)
 
 	return &http.Server{
 		Addr:    ":" + port,
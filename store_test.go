@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/iamhectorsosa/web-server/internal/database"
+)
+
+// newTestStore opens an empty JSON database in a temporary directory, for
+// tests that need more of the store than handlers do, such as its events,
+// snapshots or imports. Handler tests use newFakeStore.
+func newTestStore(t *testing.T) *database.DB {
+	t.Helper()
+
+	store, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// putChirp overwrites a stored chirp, for tests that need fields the store
+// only sets itself, such as timestamps.
+func putChirp(t *testing.T, store database.Store, chirp database.Chirp) {
+	t.Helper()
+
+	err := store.Apply(database.Event{Type: database.ChirpUpdated, Chirp: &chirp})
+	if err != nil {
+		t.Fatalf("error updating chirp: %v", err)
+	}
+}